@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// archiveKey returns where part of parts of the digest of a window is
+// archived, like tweets/digests/2020-03-03-1.html. Rolling digests share
+// their window, so they are told apart by when they were sent.
+func archiveKey(f *feed, w window, part, parts int) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(w.key, keyPrefix(f)), "/tweets.json")
+	if w.start.IsZero() {
+		name += w.end.Format("-150405")
+	}
+	if parts > 1 {
+		name += fmt.Sprintf("-%d", part)
+	}
+	return keyPrefix(f) + "digests/" + name + ".html"
+}
+
+// archiveEmail stores the HTML body of an email that was sent when
+// archive_html is set, as it was sent but for mirrored media, which it links
+// without presigning. The email is already out, so failing to archive it is
+// only logged. Nothing is archived in dry-run mode, as nothing was sent.
+func archiveEmail(ctx context.Context, f *feed, w window, part, parts int, e digestEmail) {
+	if !*archive_html || *dry_run {
+		return
+	}
+	key := archiveKey(f, w, part, parts)
+	err := tweetStore.PutObject(ctx, key, []byte(e.htmlBody), "text/html; charset=utf-8")
+	if err != nil {
+		slog.Error("Archiving email failed", "event", "archive_failed", "feed", f.Name, "key", key, "error", err.Error())
+		recordMetric("ArchiveFailures", 1, cloudwatch.StandardUnitCount)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveKey(t *testing.T) {
+	defineConfig()
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	w := window{key: "tweets/news/2020-03-03-1/tweets.json", start: start, end: start.Add(8 * time.Hour)}
+	news := &feed{Name: "news"}
+
+	for _, test := range []struct {
+		w           window
+		part, parts int
+		want        string
+	}{
+		{w, 1, 1, "tweets/news/digests/2020-03-03-1.html"},
+		{w, 2, 3, "tweets/news/digests/2020-03-03-1-2.html"},
+		{window{key: w.key, end: start.Add(time.Hour + 5*time.Minute)}, 1, 1, "tweets/news/digests/2020-03-03-1-090500.html"},
+	} {
+		if key := archiveKey(news, test.w, test.part, test.parts); key != test.want {
+			t.Errorf("archiveKey(%v, %d, %d) = %s, want %s", test.w, test.part, test.parts, key, test.want)
+		}
+	}
+}
+
+func TestArchiveHTML(t *testing.T) {
+	_, m := fakeRun(t)
+	*archive_html = true
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	if err := tweetStore.Put(ctx, previous.key, []DigestTweet{fakeTweet(1, "archived")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.html) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(m.html))
+	}
+	path := filepath.Join(tweetStore.(fsStore).dir, archiveKey(feeds[0], previous, 1, 1))
+	archived, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(archived) != m.html[0] {
+		t.Errorf("archived %s, want the HTML sent: %s", archived, m.html[0])
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// atomFeed is an Atom feed of tweets, as defined by RFC 4287
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Content atomContent `xml:"content"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atomKey returns where the Atom feed of a feed is stored
+func atomKey(f *feed) string {
+	return keyPrefix(f) + "feed.atom"
+}
+
+// publishAtom replaces a feed’s Atom feed with one entry per tweet, rendered
+// like in the email. Feed readers keep the entries they already fetched, so
+// each feed only needs the tweets of the latest window.
+func publishAtom(ctx context.Context, f *feed, tweets []DigestTweet) error {
+	data, err := buildAtom(f, sortTweets(dedupTweets(permanentMedia(tweets))))
+	if err != nil {
+		return err
+	}
+	return tweetStore.PutObject(ctx, atomKey(f), data, "application/atom+xml")
+}
+
+// buildAtom renders tweets as an Atom feed, newest first
+func buildAtom(f *feed, tweets []DigestTweet) ([]byte, error) {
+	title := msgs.DigestTitle
+	timelineURL := "https://twitter.com/home"
+	if f.ListID != 0 {
+		timelineURL = fmt.Sprintf("https://twitter.com/i/lists/%d", f.ListID)
+	}
+	if f.Name != "" {
+		title += ": " + f.Name
+	}
+
+	feedXML := atomFeed{
+		ID:      timelineURL,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: timelineURL},
+	}
+	for i := len(tweets) - 1; i > -1; i-- {
+		tweet := &tweets[i]
+		author := tweet
+		if tweet.RetweetedStatus != nil {
+			author = tweet.RetweetedStatus
+		}
+		// Entries need an author
+		if tweet.Unavailable() {
+			continue
+		}
+		tweetURL := fmt.Sprintf("https://twitter.com/%s/status/%d", author.User.ScreenName, author.ID)
+
+		updated := feedXML.Updated
+		if createdAt, err := tweet.CreatedAtTime(); err == nil {
+			updated = createdAt.UTC().Format(time.RFC3339)
+		}
+
+		feedXML.Entries = append(feedXML.Entries, atomEntry{
+			ID:      tweetURL,
+			Title:   atomTitle(author),
+			Updated: updated,
+			Link:    atomLink{Href: tweetURL},
+			Author: atomAuthor{
+				Name: author.User.Name,
+				URI:  fmt.Sprintf("https://twitter.com/%s", author.User.ScreenName),
+			},
+			Content: atomContent{Type: "html", Body: buildTweet(tweet)},
+		})
+	}
+
+	data, err := xml.MarshalIndent(feedXML, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// atomTitle returns the title of a tweet’s entry: its author and the start of
+// its text
+func atomTitle(tweet *DigestTweet) string {
+	text := []rune(strings.Join(strings.Fields(tweetPlainText(tweet)), " "))
+	if len(text) > 80 {
+		text = append(text[:79], '…')
+	}
+	return fmt.Sprintf("%s (@%s): %s", tweet.User.Name, tweet.User.ScreenName, string(text))
+}
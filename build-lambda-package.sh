@@ -1,3 +1,3 @@
 #!/bin/sh
 GOARCH=amd64 GOOS=linux go build
-zip -o twitter-to-email.zip twitter-to-email config.json
+zip -o twitter-to-email.zip twitter-to-email config.json $(ls feeds.json 2>/dev/null)
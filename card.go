@@ -0,0 +1,208 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"os"
+)
+
+// defaultCardTemplate renders a tweet as a card like the ones on twitter.com
+const defaultCardTemplate = `
+<div style="margin-bottom: 10px; font: 15px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">
+  {{- if .RetweetedBy}}
+  <div style="display: flex;">
+    <svg viewBox="0 0 24 24" style="color: rgb(45, 51, 55); fill: currentcolor; width: 13px;">
+      <g>
+        <path d="M23.615 15.477c-.47-.47-1.23-.47-1.697 0l-1.326 1.326V7.4c0-2.178-1.772-3.95-3.95-3.95h-5.2c-.663 0-1.2.538-1.2 1.2s.537 1.2 1.2 1.2h5.2c.854 0 1.55.695 1.55 1.55v9.403l-1.326-1.326c-.47-.47-1.23-.47-1.697 0s-.47 1.23 0 1.697l3.374 3.375c.234.233.542.35.85.35s.613-.116.848-.35l3.375-3.376c.467-.47.467-1.23-.002-1.697zM12.562 18.5h-5.2c-.854 0-1.55-.695-1.55-1.55V7.547l1.326 1.326c.234.235.542.352.848.352s.614-.117.85-.352c.468-.47.468-1.23 0-1.697L5.46 3.8c-.47-.468-1.23-.468-1.697 0L.388 7.177c-.47.47-.47 1.23 0 1.697s1.23.47 1.697 0L3.41 7.547v9.403c0 2.178 1.773 3.95 3.95 3.95h5.2c.664 0 1.2-.538 1.2-1.2s-.535-1.2-1.198-1.2z"></path>
+      </g>
+    </svg>
+    <a href="{{.RetweetedByURL}}" style="color: rgb(136, 153, 166); font-size: 14px; margin-left: 105px; text-decoration: none;">{{.RetweetedText}}</a>
+  </div>
+  {{- end}}
+  <div style="display: flex;">
+    <a href="{{.ProfileURL}}" style="border-radius: 9999px; flex-shrink: 0; margin-right: 5px; max-height: 100px; min-width: 100px; overflow: hidden;">
+      <img src="{{.Avatar}}" style="height: 100px; width: 100px;">
+    </a>
+    <div>
+      <div>
+        <a href="{{.ProfileURL}}" style="color: rgb(45, 51, 55); text-decoration: none;">
+          <span style="font-weight: bold;">{{.Name}}</span>
+          <span style="color: rgb(136, 153, 166);">@{{.ScreenName}}</span>
+        </a>
+        {{- if .Time}}
+        <a href="{{.URL}}" style="color: rgb(136, 153, 166); text-decoration: none;">· {{.Time}}</a>
+        {{- end}}
+        {{- if .EditedText}}
+        <span style="color: rgb(136, 153, 166);">· {{.EditedText}}</span>
+        {{- end}}
+      </div>
+      <div style="line-height: 1.3125; width: 50%;">
+        {{.Text}}
+      </div>{{.Media}}{{.Quoted}}
+      {{- if .Engagement}}
+      <div style="color: rgb(136, 153, 166); font-size: 13px; margin-top: 5px;">{{.Engagement}}</div>
+      {{- end}}
+    </div>
+  </div>
+</div>
+`
+
+// compactCardTemplate renders a tweet as a smaller card for the compact
+// layout, with the author on a single line next to a small avatar
+const compactCardTemplate = `
+<div style="margin-bottom: 6px; font: 14px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">
+  {{- if .RetweetedBy}}
+  <div style="margin-left: 42px;">
+    <a href="{{.RetweetedByURL}}" style="color: rgb(136, 153, 166); font-size: 12px; text-decoration: none;">{{.RetweetedText}}</a>
+  </div>
+  {{- end}}
+  <div style="display: flex;">
+    <a href="{{.ProfileURL}}" style="border-radius: 9999px; flex-shrink: 0; margin-right: 6px; max-height: 36px; min-width: 36px; overflow: hidden;">
+      <img src="{{.Avatar}}" style="height: 36px; width: 36px;">
+    </a>
+    <div>
+      <div style="white-space: nowrap; overflow: hidden; text-overflow: ellipsis;">
+        <a href="{{.ProfileURL}}" style="color: rgb(45, 51, 55); text-decoration: none;">
+          <span style="font-weight: bold;">{{.Name}}</span>
+          <span style="color: rgb(136, 153, 166);">@{{.ScreenName}}</span>
+        </a>
+        {{- if .Time}}
+        <a href="{{.URL}}" style="color: rgb(136, 153, 166); text-decoration: none;">· {{.Time}}</a>
+        {{- end}}
+        {{- if .EditedText}}
+        <span style="color: rgb(136, 153, 166);">· {{.EditedText}}</span>
+        {{- end}}
+      </div>
+      <div style="line-height: 1.25;">
+        {{.Text}}
+      </div>{{.Media}}{{.Quoted}}
+      {{- if .Engagement}}
+      <div style="color: rgb(136, 153, 166); font-size: 12px; margin-top: 2px;">{{.Engagement}}</div>
+      {{- end}}
+    </div>
+  </div>
+</div>
+`
+
+// compatCardTemplate renders a tweet like defaultCardTemplate for the
+// email-compat mode, laid out with tables and without the CSS older email
+// clients like Outlook ignore, such as flex and system-ui
+const compatCardTemplate = `
+<table role="presentation" border="0" cellpadding="0" cellspacing="0" style="margin-bottom: 10px; font-family: 'Segoe UI', Helvetica, Arial, sans-serif; font-size: 15px;">
+  {{- if .RetweetedBy}}
+  <tr>
+    <td></td>
+    <td style="padding-bottom: 2px;">
+      <a href="{{.RetweetedByURL}}" style="color: #8899a6; font-size: 14px; text-decoration: none;">{{.RetweetedText}}</a>
+    </td>
+  </tr>
+  {{- end}}
+  <tr>
+    <td valign="top" width="105" style="padding-right: 5px; width: 100px;">
+      <a href="{{.ProfileURL}}"><img src="{{.Avatar}}" width="100" height="100" alt="" style="border: 0; border-radius: 50px; display: block; height: 100px; width: 100px;"></a>
+    </td>
+    <td valign="top">
+      <a href="{{.ProfileURL}}" style="color: #2d3337; text-decoration: none;"><b>{{.Name}}</b> <span style="color: #8899a6;">@{{.ScreenName}}</span></a>
+      {{- if .Time}}
+      <a href="{{.URL}}" style="color: #8899a6; text-decoration: none;">· {{.Time}}</a>
+      {{- end}}
+      {{- if .EditedText}}
+      <span style="color: #8899a6;">· {{.EditedText}}</span>
+      {{- end}}
+      <div style="line-height: 1.3125;">
+        {{.Text}}
+      </div>{{.Media}}{{.Quoted}}
+      {{- if .Engagement}}
+      <div style="color: #8899a6; font-size: 13px; margin-top: 5px;">{{.Engagement}}</div>
+      {{- end}}
+    </td>
+  </tr>
+</table>
+`
+
+// compactCompatCardTemplate renders a tweet like compactCardTemplate for the
+// email-compat mode
+const compactCompatCardTemplate = `
+<table role="presentation" border="0" cellpadding="0" cellspacing="0" style="margin-bottom: 6px; font-family: 'Segoe UI', Helvetica, Arial, sans-serif; font-size: 14px;">
+  {{- if .RetweetedBy}}
+  <tr>
+    <td></td>
+    <td>
+      <a href="{{.RetweetedByURL}}" style="color: #8899a6; font-size: 12px; text-decoration: none;">{{.RetweetedText}}</a>
+    </td>
+  </tr>
+  {{- end}}
+  <tr>
+    <td valign="top" width="42" style="padding-right: 6px; width: 36px;">
+      <a href="{{.ProfileURL}}"><img src="{{.Avatar}}" width="36" height="36" alt="" style="border: 0; border-radius: 18px; display: block; height: 36px; width: 36px;"></a>
+    </td>
+    <td valign="top">
+      <a href="{{.ProfileURL}}" style="color: #2d3337; text-decoration: none;"><b>{{.Name}}</b> <span style="color: #8899a6;">@{{.ScreenName}}</span></a>
+      {{- if .Time}}
+      <a href="{{.URL}}" style="color: #8899a6; text-decoration: none;">· {{.Time}}</a>
+      {{- end}}
+      {{- if .EditedText}}
+      <span style="color: #8899a6;">· {{.EditedText}}</span>
+      {{- end}}
+      <div style="line-height: 1.25;">
+        {{.Text}}
+      </div>{{.Media}}{{.Quoted}}
+      {{- if .Engagement}}
+      <div style="color: #8899a6; font-size: 12px; margin-top: 2px;">{{.Engagement}}</div>
+      {{- end}}
+    </td>
+  </tr>
+</table>
+`
+
+var (
+	defaultCard       = htmltemplate.Must(htmltemplate.New("card").Parse(defaultCardTemplate))
+	compactCard       = htmltemplate.Must(htmltemplate.New("card").Parse(compactCardTemplate))
+	compatCard        = htmltemplate.Must(htmltemplate.New("card").Parse(compatCardTemplate))
+	compactCompatCard = htmltemplate.Must(htmltemplate.New("card").Parse(compactCompatCardTemplate))
+	// cardTemplate renders each tweet in the email, from template-file when it
+	// is set, or as set by layout and email_compat
+	cardTemplate = defaultCard
+)
+
+// cardData is what is shown of a tweet. It is passed to the card template,
+// with Text, Media and Quoted already rendered as HTML.
+type cardData struct {
+	// Set for tweets that came without their author, like deleted ones, which
+	// only have a URL and a PlainText saying so. They aren’t rendered with the
+	// template.
+	Unavailable bool
+
+	// Set for retweets, whose other fields describe the retweeted tweet
+	RetweetedBy    string
+	RetweetedByURL string
+	// Like “Alice Retweeted”, in the configured locale
+	RetweetedText string
+
+	Name       string
+	ScreenName string
+	ProfileURL string
+	Avatar     string
+	URL        string
+	// When the tweet was posted, empty if unknown
+	Time string
+	// Like “Edited” for edits of an earlier version, in the configured locale
+	EditedText string
+	// Like “1.2K Likes · 340 Retweets”, empty unless show-engagement is set
+	Engagement string
+	// The text without links to the tweet’s own media or quoted tweet
+	PlainText string
+	Photos    []string
+
+	Text   htmltemplate.HTML
+	Media  htmltemplate.HTML
+	Quoted htmltemplate.HTML
+}
+
+// loadCardTemplate parses the card template in a file
+func loadCardTemplate(path string) (*htmltemplate.Template, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return htmltemplate.New("card").Parse(string(source))
+}
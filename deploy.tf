@@ -70,6 +70,24 @@ resource "aws_iam_role_policy_attachment" "ses_access_policy" {
   policy_arn = data.aws_iam_policy.AmazonSESFullAccess.arn
 }
 
+# Policy to allow publishing custom metrics
+resource "aws_iam_role_policy" "cloudwatch_metrics_policy" {
+  name = "TwitterToEmailMetrics"
+  role = aws_iam_role.twitter_to_email_iam_role.id
+  policy = jsonencode(
+    {
+      Statement = [
+        {
+          Action   = "cloudwatch:PutMetricData"
+          Effect   = "Allow"
+          Resource = "*"
+        },
+      ]
+      Version = "2012-10-17"
+    }
+  )
+}
+
 
 # Lambda function to fetch tweets periodically, store them in
 # S3, and email them as a digest every 24hrs
@@ -1,6 +1,6 @@
 module github.com/deepakjois/twitter-to-email
 
-go 1.13
+go 1.21
 
 require (
 	github.com/aws/aws-lambda-go v1.13.2
@@ -10,3 +10,10 @@ require (
 	github.com/peterbourgon/ff v1.6.0
 	github.com/spf13/viper v1.4.0
 )
+
+require (
+	github.com/cenkalti/backoff v2.1.1+incompatible // indirect
+	github.com/dghubble/sling v1.3.0 // indirect
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// lastRun is the heartbeat recorded at the end of every invocation, for
+// monitors to alert on when it goes stale. It is separate from the since_id
+// of each feed.
+type lastRun struct {
+	Started       time.Time    `json:"started"`
+	Finished      time.Time    `json:"finished"`
+	Status        string       `json:"status"`
+	Error         string       `json:"error,omitempty"`
+	NewTweetCount int          `json:"new_tweet_count"`
+	Emailed       bool         `json:"emailed"`
+	Feeds         []FeedResult `json:"feeds"`
+}
+
+// lastRunKey returns where the heartbeat is stored
+func lastRunKey() string {
+	if *last_run_key != "" {
+		return *last_run_key
+	}
+	return *key_prefix + "last_run.json"
+}
+
+// recordLastRun stores the heartbeat of a run that started at started,
+// whether it succeeded or not. Recording is best-effort, failures are only
+// logged.
+func recordLastRun(ctx context.Context, started time.Time, result Result, runErr error) {
+	run := lastRun{
+		Started:       started.UTC(),
+		Finished:      clock().UTC(),
+		Status:        "ok",
+		NewTweetCount: result.NewTweetCount,
+		Emailed:       result.Emailed,
+		Feeds:         result.Feeds,
+	}
+	if runErr != nil {
+		run.Status = "failed"
+		run.Error = runErr.Error()
+	}
+
+	data, err := json.Marshal(run)
+	if err == nil {
+		err = tweetStore.PutObject(ctx, lastRunKey(), data, jsonContentType)
+	}
+	if err != nil {
+		slog.Warn("Could not record the last run", "event", "last_run_failed", "key", lastRunKey(), "error", err.Error())
+	}
+}
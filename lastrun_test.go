@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordLastRun(t *testing.T) {
+	source, _ := fakeRun(t)
+	source.timeline = []DigestTweet{fakeTweet(1, "one")}
+	dir := t.TempDir()
+	tweetStore = fsStore{dir: dir}
+
+	readLastRun := func() lastRun {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, "tweets", "last_run.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var run lastRun
+		if err := json.Unmarshal(data, &run); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+
+	if _, err := handleInvocation(context.Background(), Invocation{}); err != nil {
+		t.Fatal(err)
+	}
+	run := readLastRun()
+	if run.Status != "ok" || run.Error != "" || run.NewTweetCount != 1 || len(run.Feeds) != 1 {
+		t.Errorf("successful run recorded as %+v", run)
+	}
+	if run.Finished.Before(run.Started) || run.Started.IsZero() {
+		t.Errorf("run recorded as finishing at %v, before starting at %v", run.Finished, run.Started)
+	}
+
+	if _, err := handleInvocation(context.Background(), Invocation{CatchUpStart: "yesterday"}); err == nil {
+		t.Fatal("invalid catch-up start was accepted")
+	}
+	if run := readLastRun(); run.Status != "failed" || run.Error == "" {
+		t.Errorf("failed run recorded as %+v", run)
+	}
+
+	*last_run_key = "monitoring/heartbeat.json"
+	if _, err := handleInvocation(context.Background(), Invocation{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "monitoring", "heartbeat.json")); err != nil {
+		t.Errorf("last-run-key wasn’t used: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// messages are the digest’s own strings in one language. The tweets are left
+// as they were written.
+type messages struct {
+	// SubjectTemplate is used when no subject-template is configured
+	SubjectTemplate string
+	// DateLayout formats dates with a time of day, TimeLayout only the time.
+	// Go only knows English month names, so other locales use numeric dates.
+	DateLayout, TimeLayout string
+
+	// Retweeted says who retweeted a tweet, given their name
+	Retweeted string
+	// Unavailable stands in for a tweet that came without its author
+	Unavailable string
+	// Edited marks edits of an earlier version of a tweet
+	Edited string
+	// Likes and Retweets count the likes and retweets of a tweet, given the
+	// count formatted compactly
+	Likes, Retweets string
+	// Tweets counts the tweets of a digest
+	Tweets string
+	// TweetsPosted counts the tweets of a digest, given when the first and
+	// last were posted
+	TweetsPosted string
+	// CatchingUp says that no tweets were posted in a window, given its
+	// bounds and the TweetsPosted line of the digest
+	CatchingUp string
+	// More says how many tweets were left out of a digest
+	More string
+	// NoTweetsSubject and NoTweets are the subject and text of the email
+	// send-empty-digest sends when there are no tweets, given what it covers
+	NoTweetsSubject, NoTweets string
+	// DigestTitle is the title of the Atom feed
+	DigestTitle string
+	// FeedDigest says which feed a digest is from, given its title
+	FeedDigest string
+}
+
+// locales are the messages of each supported locale
+var locales = map[string]messages{
+	"en": {
+		SubjectTemplate: `{{.Count}} tweets · {{.Start.Format "Jan 2 15:04"}}–{{if .SameDay}}{{.End.Format "15:04"}}{{else}}{{.End.Format "Jan 2 15:04"}}{{end}}`,
+		DateLayout:      "Jan 2 15:04",
+		TimeLayout:      "15:04",
+		Retweeted:       "%s Retweeted",
+		Unavailable:     "This tweet is unavailable",
+		Edited:          "Edited",
+		Likes:           "%s Likes",
+		Retweets:        "%s Retweets",
+		Tweets:          "%d tweets",
+		TweetsPosted:    "%d tweets posted %s–%s",
+		CatchingUp:      "No tweets were posted in the window %s–%s. Catching up on %s.",
+		More:            "+%d more",
+		NoTweetsSubject: "No new tweets · %s",
+		NoTweets:        "No new tweets for %s.",
+		DigestTitle:     "Twitter digest",
+		FeedDigest:      "%s digest",
+	},
+	"de": {
+		SubjectTemplate: `{{.Count}} Tweets · {{.Start.Format "2.1. 15:04"}}–{{if .SameDay}}{{.End.Format "15:04"}}{{else}}{{.End.Format "2.1. 15:04"}}{{end}}`,
+		DateLayout:      "2.1. 15:04",
+		TimeLayout:      "15:04",
+		Retweeted:       "%s hat retweetet",
+		Unavailable:     "Dieser Tweet ist nicht verfügbar",
+		Edited:          "Bearbeitet",
+		Likes:           "%s „Gefällt mir“-Angaben",
+		Retweets:        "%s Retweets",
+		Tweets:          "%d Tweets",
+		TweetsPosted:    "%d Tweets vom %s bis %s",
+		CatchingUp:      "Zwischen %s und %s wurden keine Tweets gepostet. Nachgeholt: %s.",
+		More:            "+%d weitere",
+		NoTweetsSubject: "Keine neuen Tweets · %s",
+		NoTweets:        "Keine neuen Tweets für %s.",
+		DigestTitle:     "Twitter-Zusammenfassung",
+		FeedDigest:      "Zusammenfassung %s",
+	},
+	"es": {
+		SubjectTemplate: `{{.Count}} tweets · {{.Start.Format "2/1 15:04"}}–{{if .SameDay}}{{.End.Format "15:04"}}{{else}}{{.End.Format "2/1 15:04"}}{{end}}`,
+		DateLayout:      "2/1 15:04",
+		TimeLayout:      "15:04",
+		Retweeted:       "%s retuiteó",
+		Unavailable:     "Este tweet no está disponible",
+		Edited:          "Editado",
+		Likes:           "%s Me gusta",
+		Retweets:        "%s Retweets",
+		Tweets:          "%d tweets",
+		TweetsPosted:    "%d tweets publicados entre el %s y el %s",
+		CatchingUp:      "No se publicaron tweets entre el %s y el %s. Recuperando %s.",
+		More:            "+%d más",
+		NoTweetsSubject: "Sin tweets nuevos · %s",
+		NoTweets:        "No hay tweets nuevos para %s.",
+		DigestTitle:     "Resumen de Twitter",
+		FeedDigest:      "Resumen %s",
+	},
+	"fr": {
+		SubjectTemplate: `{{.Count}} tweets · {{.Start.Format "2/1 15:04"}}–{{if .SameDay}}{{.End.Format "15:04"}}{{else}}{{.End.Format "2/1 15:04"}}{{end}}`,
+		DateLayout:      "2/1 15:04",
+		TimeLayout:      "15:04",
+		Retweeted:       "%s a retweeté",
+		Unavailable:     "Ce tweet n’est pas disponible",
+		Edited:          "Modifié",
+		Likes:           "%s J’aime",
+		Retweets:        "%s Retweets",
+		Tweets:          "%d tweets",
+		TweetsPosted:    "%d tweets publiés entre le %s et le %s",
+		CatchingUp:      "Aucun tweet n’a été publié entre le %s et le %s. Rattrapage : %s.",
+		More:            "+%d de plus",
+		NoTweetsSubject: "Aucun nouveau tweet · %s",
+		NoTweets:        "Aucun nouveau tweet pour %s.",
+		DigestTitle:     "Résumé Twitter",
+		FeedDigest:      "Résumé %s",
+	},
+}
+
+// msgs are the messages of the configured locale
+var msgs = locales["en"]
+
+// localeNames returns the supported locales, for error messages
+func localeNames() string {
+	var names []string
+	for name := range locales {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
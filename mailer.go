@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+)
+
+// Mailer sends a digest email with an HTML body and a plain-text alternative
+type Mailer interface {
+	Send(subject, htmlBody, textBody string) error
+}
+
+// newMailer returns the Mailer selected by the mailer option, sending to the
+// recipients of a feed. ctx bounds the calls made by the SES mailer.
+func newMailer(ctx context.Context, f *feed) (Mailer, error) {
+	if *dry_run {
+		return dryRunMailer{}, nil
+	}
+
+	switch *mailer {
+	case "ses":
+		return sesMailer{ctx: ctx, to: f.toAddresses}, nil
+	case "smtp":
+		return smtpMailer{to: aws.StringValueSlice(f.toAddresses)}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", *mailer)
+	}
+}
+
+// sesClient returns an SES client. SES is only available in limited AWS
+// regions, so we hardcode the region here.
+func sesClient() *ses.SES {
+	return ses.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("us-west-2")},
+	)))
+}
+
+// sesMailer sends email through Amazon SES
+type sesMailer struct {
+	ctx context.Context
+	to  []*string
+}
+
+func (m sesMailer) Send(subject, htmlBody, textBody string) error {
+	svc := sesClient()
+
+	if *raw_email {
+		return m.sendRaw(svc, subject, htmlBody, textBody)
+	}
+
+	// Assemble the email.
+	input := &ses.SendEmailInput{
+		Destination: &ses.Destination{
+			ToAddresses:  m.to,
+			CcAddresses:  ccAddresses,
+			BccAddresses: bccAddresses,
+		},
+		Message: &ses.Message{
+			Body: &ses.Body{
+				Html: &ses.Content{
+					Charset: aws.String("UTF-8"),
+					Data:    aws.String(htmlBody),
+				},
+				Text: &ses.Content{
+					Charset: aws.String("UTF-8"),
+					Data:    aws.String(textBody),
+				},
+			},
+			Subject: &ses.Content{
+				Charset: aws.String("UTF-8"),
+				Data:    aws.String(subject),
+			},
+		},
+		Source: from,
+	}
+
+	// Attempt to send the email.
+	return retryAWS(m.ctx, "ses:SendEmail", func(ctx context.Context) error {
+		_, err := svc.SendEmailWithContext(ctx, input)
+		return err
+	})
+}
+
+// sendRaw sends the email as a MIME message built here, so that it can carry
+// the headers set by the list-unsubscribe and reply-to options
+func (m sesMailer) sendRaw(svc *ses.SES, subject, htmlBody, textBody string) error {
+	message, err := buildMIMEMessage(*from, aws.StringValueSlice(m.to), subject, htmlBody, textBody, extraHeaders())
+	if err != nil {
+		return err
+	}
+
+	// Bcc recipients are only in the envelope
+	destinations := append(append(append([]*string{}, m.to...), ccAddresses...), bccAddresses...)
+	return retryAWS(m.ctx, "ses:SendRawEmail", func(ctx context.Context) error {
+		_, err := svc.SendRawEmailWithContext(ctx, &ses.SendRawEmailInput{
+			Destinations: destinations,
+			RawMessage:   &ses.RawMessage{Data: message},
+			Source:       from,
+		})
+		return err
+	})
+}
+
+// extraHeaders returns the headers set by the cc, list-unsubscribe and
+// reply-to options
+func extraHeaders() textproto.MIMEHeader {
+	headers := textproto.MIMEHeader{}
+	if len(ccAddresses) > 0 {
+		// Formatted as addresses, as display names are encoded differently
+		var cc []string
+		for _, address := range aws.StringValueSlice(ccAddresses) {
+			if parsed, err := mail.ParseAddress(address); err == nil {
+				cc = append(cc, parsed.String())
+			}
+		}
+		headers.Set("Cc", strings.Join(cc, ", "))
+	}
+	if *list_unsubscribe != "" {
+		headers.Set("List-Unsubscribe", *list_unsubscribe)
+	}
+	if *reply_to != "" {
+		headers.Set("Reply-To", *reply_to)
+	}
+	return headers
+}
+
+// smtpMailer sends email through the SMTP server configured by the smtp-*
+// options, authenticating when smtp-user is set
+type smtpMailer struct {
+	to []string
+}
+
+func (m smtpMailer) Send(subject, htmlBody, textBody string) error {
+	message, err := buildMIMEMessage(*from, m.to, subject, htmlBody, textBody, extraHeaders())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if *smtp_user != "" {
+		auth = smtp.PlainAuth("", *smtp_user, *smtp_pass, *smtp_host)
+	}
+
+	// Envelope addresses are bare, while headers may carry display names
+	sender, err := envelopeAddress(*from)
+	if err != nil {
+		return err
+	}
+	// Bcc recipients are only in the envelope
+	var recipients []string
+	all := append(append(append([]string{}, m.to...), aws.StringValueSlice(ccAddresses)...), aws.StringValueSlice(bccAddresses)...)
+	for _, to := range all {
+		recipient, err := envelopeAddress(to)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	addr := net.JoinHostPort(*smtp_host, strconv.Itoa(*smtp_port))
+	return smtp.SendMail(addr, auth, sender, recipients, message)
+}
+
+// buildMIMEMessage assembles a multipart/alternative email with plain-text and
+// HTML parts, and extra headers
+func buildMIMEMessage(from string, to []string, subject, htmlBody, textBody string, headers textproto.MIMEHeader) ([]byte, error) {
+	buf := bytes.Buffer{}
+	body := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, mime.QEncoding.Encode("UTF-8", value))
+		}
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	// Clients show the last alternative they support, so HTML goes last
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", textBody},
+		{"text/html; charset=UTF-8", htmlBody},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fromAddress returns the address to send from, with name as its display name
+// when it is set, encoded as RFC 2047 if it isn’t ASCII
+func fromAddress(from, name string) (string, error) {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid from address %q: %v", from, err)
+	}
+	if name == "" {
+		return from, nil
+	}
+
+	named := (&mail.Address{Name: name, Address: address.Address}).String()
+	if _, err := mail.ParseAddress(named); err != nil {
+		return "", fmt.Errorf("invalid from-name %q: %v", name, err)
+	}
+	return named, nil
+}
+
+// envelopeAddress returns the bare address of an email address that may carry
+// a display name
+func envelopeAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
+
+// dryRunMailer writes the email that would have been sent to dry-run-file, or
+// stdout when it isn’t set. Every email of a run is appended to the file, like
+// the parts of a split digest.
+type dryRunMailer struct{}
+
+// truncateDryRunFile empties dry-run-file at the start of a dry run, so that
+// it holds the emails of that run only
+func truncateDryRunFile() error {
+	if !*dry_run || *dry_run_file == "" {
+		return nil
+	}
+	f, err := os.Create(*dry_run_file)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (dryRunMailer) Send(subject, htmlBody, textBody string) error {
+	out := io.Writer(os.Stdout)
+	if *dry_run_file != "" {
+		f, err := os.OpenFile(*dry_run_file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+		slog.Info("Writing email to file instead of sending it", "event", "dry_run", "file", *dry_run_file)
+	}
+
+	_, err := fmt.Fprintf(out, "<!-- Subject: %s -->\n%s\n", subject, htmlBody)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestBuildMIMEMessage(t *testing.T) {
+	headers := textproto.MIMEHeader{}
+	headers.Set("List-Unsubscribe", "<mailto:me@example.com?subject=unsubscribe>")
+	headers.Set("Reply-To", "me@example.com")
+
+	message, err := buildMIMEMessage("Digest <me@example.com>", []string{"a@example.com", "b@example.com"},
+		"12 tweets · Mar 3", "<p>html</p>", "text", headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(message)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"To":               "a@example.com, b@example.com",
+		"List-Unsubscribe": "<mailto:me@example.com?subject=unsubscribe>",
+		"Reply-To":         "me@example.com",
+	} {
+		if value := parsed.Header.Get(name); value != expected {
+			t.Errorf("%s header is %q, want %q", name, value, expected)
+		}
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != "12 tweets · Mar 3" {
+		t.Errorf("Subject decodes to %q, %v", subject, err)
+	}
+
+	body, err := io.ReadAll(parsed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"Content-Type: text/plain; charset=UTF-8", "Content-Type: text/html; charset=UTF-8", "<p>html</p>"} {
+		if !strings.Contains(string(body), part) {
+			t.Errorf("Body is missing %q: %s", part, body)
+		}
+	}
+}
+
+func TestExtraHeadersCc(t *testing.T) {
+	defineConfig()
+	ccAddresses = aws.StringSlice([]string{"Archive <archive@example.com>", "b@example.com"})
+	bccAddresses = aws.StringSlice([]string{"me@example.com"})
+	defer func() { ccAddresses, bccAddresses = nil, nil }()
+
+	headers := extraHeaders()
+	if cc := headers.Get("Cc"); cc != `"Archive" <archive@example.com>, <b@example.com>` {
+		t.Errorf("Cc header is %q", cc)
+	}
+	if bcc := headers.Get("Bcc"); bcc != "" {
+		t.Errorf("Bcc header is %q, want none", bcc)
+	}
+}
+
+func TestFromAddress(t *testing.T) {
+	tests := []struct {
+		from, name, want string
+	}{
+		{"me@example.com", "", "me@example.com"},
+		{"Me <me@example.com>", "", "Me <me@example.com>"},
+		{"me@example.com", "Twitter Digest", `"Twitter Digest" <me@example.com>`},
+		{"Me <me@example.com>", "Twitter Digest", `"Twitter Digest" <me@example.com>`},
+		{"me@example.com", "Résumé des tweets", "=?utf-8?q?R=C3=A9sum=C3=A9_des_tweets?= <me@example.com>"},
+	}
+	for _, test := range tests {
+		got, err := fromAddress(test.from, test.name)
+		if err != nil || got != test.want {
+			t.Errorf("fromAddress(%q, %q) = %q, %v, want %q", test.from, test.name, got, err, test.want)
+		}
+	}
+
+	if _, err := fromAddress("not an address", "Twitter Digest"); err == nil {
+		t.Error("fromAddress accepted an invalid address")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// markdownEscaper escapes the characters Markdown would otherwise format
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`,
+	"\n", "  \n")
+
+// buildTweetMarkdown renders a tweet as Markdown, with the same links as the
+// email
+func buildTweetMarkdown(tweet *DigestTweet) string {
+	data := newCardData(tweet)
+	if data.Unavailable {
+		return fmt.Sprintf("_%s_  \n[View tweet](%s)\n\n", markdownEscaper.Replace(data.PlainText), data.URL)
+	}
+	if tweet.RetweetedStatus != nil {
+		tweet = tweet.RetweetedStatus
+	}
+
+	builder := strings.Builder{}
+	if data.RetweetedBy != "" {
+		builder.WriteString(fmt.Sprintf("_%s_  \n", markdownEscaper.Replace(data.RetweetedText)))
+	}
+	builder.WriteString(fmt.Sprintf("**%s** [@%s](%s)", markdownEscaper.Replace(data.Name), markdownEscaper.Replace(data.ScreenName), data.ProfileURL))
+	if data.Time != "" {
+		builder.WriteString(fmt.Sprintf(" · [%s](%s)", markdownEscaper.Replace(data.Time), data.URL))
+	}
+	builder.WriteString(": " + tweetMarkdownText(tweet) + "\n")
+
+	for _, photo := range data.Photos {
+		builder.WriteString(fmt.Sprintf("\n![Photo](%s)\n", photo))
+	}
+	if quoted := tweet.QuotedStatus; quoted != nil && quoted.User == nil {
+		builder.WriteString(fmt.Sprintf("\n> _%s_\n", markdownEscaper.Replace(msgs.Unavailable)))
+	} else if quoted != nil {
+		builder.WriteString(fmt.Sprintf("\n> **%s** @%s: %s\n",
+			markdownEscaper.Replace(quoted.User.Name),
+			markdownEscaper.Replace(quoted.User.ScreenName),
+			strings.Replace(tweetMarkdownText(quoted), "\n", "\n> ", -1)))
+	}
+	builder.WriteString(fmt.Sprintf("\n[View tweet](%s)\n\n", data.URL))
+
+	return builder.String()
+}
+
+// tweetMarkdownText renders the text of a tweet as Markdown, expanding and
+// stripping links like tweetText
+func tweetMarkdownText(tweet *DigestTweet) string {
+	return spliceText(tweet, func(href, label string) string {
+		return fmt.Sprintf("[%s](%s)", markdownEscaper.Replace(label), href)
+	}, markdownEscaper.Replace)
+}
+
+// buildMarkdown renders the tweets of a digest oldest first as a Markdown
+// document titled by subject
+func buildMarkdown(subject string, tweets []DigestTweet) string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("# %s\n\n", markdownEscaper.Replace(subject)))
+	for _, tweet := range sortTweets(tweets) {
+		builder.WriteString(buildTweetMarkdown(&tweet))
+	}
+	return builder.String()
+}
+
+// markdownKey returns where the Markdown digest of a window is stored.
+// Rolling digests share their window, so each is stored under when it was
+// sent, rather than replacing the ones sent before it.
+func markdownKey(w window) string {
+	name := "digest"
+	if w.start.IsZero() {
+		name += w.end.Format("-150405")
+	}
+	return strings.TrimSuffix(w.key, "tweets.json") + name + ".md"
+}
+
+// publishMarkdown stores the Markdown digest of a window next to its tweets,
+// or writes it to stdout in dry-run mode
+func publishMarkdown(ctx context.Context, f *feed, w window, tweets []DigestTweet) error {
+	tweets = dedupTweets(tweets)
+	subject, err := buildSubject(f, digestSpan(w, tweets))
+	if err != nil {
+		return err
+	}
+	digest := buildMarkdown(subject, tweets)
+
+	if *dry_run {
+		_, err := fmt.Fprint(os.Stdout, digest)
+		return err
+	}
+	return tweetStore.PutObject(ctx, markdownKey(w), []byte(digest), "text/markdown; charset=utf-8")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTweetMarkdown(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	tweet := DigestTweet{
+		ID:        1,
+		CreatedAt: "Tue Mar 03 14:05:00 +0000 2020",
+		FullText:  "Read *this* https://t.co/link #go https://t.co/cat",
+		Entities: &TweetEntities{
+			Urls: []URLEntity{{
+				Indices:     Indices{12, 29},
+				URL:         "https://t.co/link",
+				DisplayURL:  "example.com/link",
+				ExpandedURL: "https://example.com/link",
+			}},
+			Hashtags: []HashtagEntity{{Indices: Indices{30, 33}, Text: "go"}},
+		},
+		ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{{
+			URLEntity:     URLEntity{Indices: Indices{34, 50}, URL: "https://t.co/cat"},
+			Type:          "photo",
+			MediaURLHttps: "https://pbs.twimg.com/media/cat.jpg",
+		}}},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+
+	expected := "**Alice** [@alice](https://twitter.com/alice) · [Mar 3 14:05](https://twitter.com/alice/status/1): " +
+		`Read \*this\* [example.com/link](https://example.com/link) [\#go](https://twitter.com/hashtag/go)` + "\n" +
+		"\n![Photo](https://pbs.twimg.com/media/cat.jpg)\n" +
+		"\n[View tweet](https://twitter.com/alice/status/1)\n\n"
+	if markdown := buildTweetMarkdown(&tweet); markdown != expected {
+		t.Errorf("Markdown is:\n%s\nwant:\n%s", markdown, expected)
+	}
+	if !strings.HasPrefix(buildMarkdown("1 tweets", []DigestTweet{tweet}), "# 1 tweets\n\n**Alice**") {
+		t.Errorf("Digest doesn’t start with its title")
+	}
+}
+
+func TestMarkdownKey(t *testing.T) {
+	defineConfig()
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	w := window{key: "tweets/2020-03-03-1/tweets.json", start: start, end: start.Add(8 * time.Hour)}
+	if key := markdownKey(w); key != "tweets/2020-03-03-1/digest.md" {
+		t.Errorf("window digest is stored at %s", key)
+	}
+
+	// Two rolling digests of the same window
+	first := window{key: w.key, end: start.Add(time.Hour + 5*time.Minute)}
+	second := window{key: w.key, end: start.Add(2 * time.Hour)}
+	if key := markdownKey(first); key != "tweets/2020-03-03-1/digest-090500.md" {
+		t.Errorf("rolling digest is stored at %s", key)
+	}
+	if markdownKey(first) == markdownKey(second) {
+		t.Error("rolling digests of a window are stored at the same key")
+	}
+}
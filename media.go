@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// maxPresignExpiry is the longest S3 presigned URLs stay valid
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// presigner is a Store that can hand out URLs reading a key without
+// credentials
+type presigner interface {
+	// PresignGet returns a URL reading key that stays valid for expiry
+	PresignGet(key string, expiry time.Duration) (string, error)
+	// ObjectURL returns the URL of key, which doesn’t expire but needs key to
+	// be readable by anyone
+	ObjectURL(key string) (string, error)
+}
+
+// mediaKey returns where the nth media of a tweet is mirrored
+func mediaKey(tweetID int64, n int) string {
+	return fmt.Sprintf("%smedia/%d/%d", *key_prefix, tweetID, n)
+}
+
+// mirrorMedia copies the photos and video previews of tweets, and of the
+// tweets they retweet or quote, into the store when mirror_media is set, and
+// records where in each media. Media failing to download keep their Twitter
+// URLs.
+func mirrorMedia(ctx context.Context, tweets []DigestTweet) {
+	if !*mirror_media {
+		return
+	}
+	for i := range tweets {
+		for _, tweet := range []*DigestTweet{&tweets[i], tweets[i].RetweetedStatus, tweets[i].QuotedStatus} {
+			if tweet == nil || tweet.ExtendedEntities == nil {
+				continue
+			}
+			media := tweet.ExtendedEntities.Media
+			for n := range media {
+				if media[n].MirrorKey != "" || media[n].MediaURLHttps == "" {
+					continue
+				}
+				key := mediaKey(tweet.ID, n)
+				if err := mirrorImage(ctx, media[n].MediaURLHttps, key); err != nil {
+					slog.Warn("Could not mirror media, keeping its Twitter URL", "event", "mirror_media_failed", "url", media[n].MediaURLHttps, "key", key, "error", err.Error())
+					recordMetric("MirrorMediaFailures", 1, cloudwatch.StandardUnitCount)
+					continue
+				}
+				media[n].MirrorKey = key
+			}
+		}
+	}
+}
+
+// mirrorImage downloads the image at url, bounded by request_timeout, and
+// stores it at key with the content type it was served with
+func mirrorImage(ctx context.Context, url, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, *request_timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return tweetStore.PutObject(ctx, key, data, contentType)
+}
+
+// permanentMedia returns copies of tweets whose mirrored media link the
+// objects they were copied to rather than presigned URLs, which expire, for
+// what is kept like the Atom feed and the HTML archive. Stores that can’t link
+// objects keep the Twitter URLs.
+func permanentMedia(tweets []DigestTweet) []DigestTweet {
+	if !*mirror_media {
+		return tweets
+	}
+	permanent := make([]DigestTweet, len(tweets))
+	for i := range tweets {
+		permanent[i] = permanentTweet(tweets[i])
+	}
+	return permanent
+}
+
+// permanentTweet returns a copy of a tweet, and of the tweets it retweets or
+// quotes, whose mirrored media aren’t presigned
+func permanentTweet(tweet DigestTweet) DigestTweet {
+	for _, status := range []**DigestTweet{&tweet.RetweetedStatus, &tweet.QuotedStatus} {
+		if *status != nil {
+			copied := permanentTweet(**status)
+			*status = &copied
+		}
+	}
+	if tweet.ExtendedEntities == nil {
+		return tweet
+	}
+
+	p, linked := tweetStore.(presigner)
+	media := append([]MediaEntity{}, tweet.ExtendedEntities.Media...)
+	for n := range media {
+		if media[n].MirrorKey == "" {
+			continue
+		}
+		if linked {
+			url, err := p.ObjectURL(media[n].MirrorKey)
+			if err == nil {
+				media[n].MediaURLHttps = url
+			}
+		}
+		media[n].MirrorKey = ""
+	}
+	tweet.ExtendedEntities = &ExtendedEntities{Media: media}
+	return tweet
+}
+
+// mediaSrc returns the URL of a media’s image: a presigned URL of its copy
+// when it was mirrored, or its Twitter URL otherwise or if presigning fails
+func mediaSrc(media MediaEntity) string {
+	if !*mirror_media || media.MirrorKey == "" {
+		return media.MediaURLHttps
+	}
+	p, ok := tweetStore.(presigner)
+	if !ok {
+		return media.MediaURLHttps
+	}
+	url, err := p.PresignGet(media.MirrorKey, *mirror_media_expiry)
+	if err != nil {
+		slog.Warn("Could not presign mirrored media, using its Twitter URL", "event", "presign_failed", "key", media.MirrorKey, "error", err.Error())
+		return media.MediaURLHttps
+	}
+	return url
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// presigningStore is an fsStore presigning keys with a fake URL
+type presigningStore struct {
+	fsStore
+}
+
+func (s presigningStore) PresignGet(key string, expiry time.Duration) (string, error) {
+	return "https://bucket.example.com/" + key + "?expires=" + expiry.String(), nil
+}
+
+func (s presigningStore) ObjectURL(key string) (string, error) {
+	return "https://bucket.example.com/" + key, nil
+}
+
+func TestMirrorMedia(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg"))
+	}))
+	defer srv.Close()
+
+	defineConfig()
+	*mirror_media = true
+	*mirror_media_expiry = time.Hour
+	dir := t.TempDir()
+	tweetStore = presigningStore{fsStore{dir: dir}}
+	alice := &TweetUser{Name: "Alice", ScreenName: "alice"}
+	tweets := []DigestTweet{
+		{ID: 1, User: alice, ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{
+			{Type: "photo", MediaURLHttps: srv.URL + "/ok.jpg"},
+			{Type: "photo", MediaURLHttps: srv.URL + "/gone.jpg"},
+		}}},
+		{ID: 2, User: alice, RetweetedStatus: &DigestTweet{ID: 3, User: alice, ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{
+			{Type: "photo", MediaURLHttps: srv.URL + "/ok.jpg"},
+		}}}},
+	}
+
+	mirrorMedia(context.Background(), tweets)
+	if data, err := os.ReadFile(filepath.Join(dir, "tweets", "media", "1", "0")); err != nil || string(data) != "jpeg" {
+		t.Errorf("mirrored media is %q, %v, want the downloaded image", data, err)
+	}
+	want := []string{"https://bucket.example.com/tweets/media/1/0?expires=1h0m0s", srv.URL + "/gone.jpg"}
+	if photos := tweetPhotos(&tweets[0]); !reflect.DeepEqual(photos, want) {
+		t.Errorf("photos are %q, want %q", photos, want)
+	}
+	if key := tweets[1].RetweetedStatus.ExtendedEntities.Media[0].MirrorKey; key != "tweets/media/3/0" {
+		t.Errorf("retweeted media was mirrored at %q", key)
+	}
+
+	// What is kept links the copies rather than URLs that expire
+	permanent := permanentMedia(tweets)
+	want = []string{"https://bucket.example.com/tweets/media/1/0", srv.URL + "/gone.jpg"}
+	if photos := tweetPhotos(&permanent[0]); !reflect.DeepEqual(photos, want) {
+		t.Errorf("permanent photos are %q, want %q", photos, want)
+	}
+	if photos := tweetPhotos(permanent[1].RetweetedStatus); photos[0] != "https://bucket.example.com/tweets/media/3/0" {
+		t.Errorf("permanent retweeted photo is at %s", photos[0])
+	}
+	if key := tweets[0].ExtendedEntities.Media[0].MirrorKey; key != "tweets/media/1/0" {
+		t.Errorf("permanentMedia changed the tweets passed to it")
+	}
+
+	*mirror_media = false
+	if photos := tweetPhotos(&tweets[0]); photos[0] != srv.URL+"/ok.jpg" {
+		t.Errorf("without mirror-media, the photo is at %s", photos[0])
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// maxMetricsPerRequest is the most metrics PutMetricData accepts at once
+const maxMetricsPerRequest = 20
+
+// metricData accumulates the metrics of a run until publishMetrics sends them
+var metricData []*cloudwatch.MetricDatum
+
+// recordMetric adds a metric to be published at the end of the run
+func recordMetric(name string, value float64, unit string) {
+	metricData = append(metricData, &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Timestamp:  aws.Time(time.Now()),
+		Unit:       aws.String(unit),
+		Value:      aws.Float64(value),
+	})
+}
+
+// recordLatency adds a metric for the time elapsed since start
+func recordLatency(name string, start time.Time) {
+	recordMetric(name, float64(time.Since(start))/float64(time.Millisecond), cloudwatch.StandardUnitMilliseconds)
+}
+
+// publishMetrics sends the metrics recorded during the run to CloudWatch,
+// along with whether the run succeeded. Publishing is best-effort, failures are
+// only logged.
+func publishMetrics(ctx context.Context, runErr error) {
+	if runErr == nil {
+		recordMetric("Success", 1, cloudwatch.StandardUnitCount)
+		recordMetric("Failure", 0, cloudwatch.StandardUnitCount)
+	} else {
+		recordMetric("Success", 0, cloudwatch.StandardUnitCount)
+		recordMetric("Failure", 1, cloudwatch.StandardUnitCount)
+	}
+
+	data := metricData
+	metricData = nil
+	if *metrics_namespace == "" {
+		return
+	}
+
+	svc := cloudwatch.New(sess)
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxMetricsPerRequest {
+			n = maxMetricsPerRequest
+		}
+		_, err := putMetricData(ctx, svc, &cloudwatch.PutMetricDataInput{
+			Namespace:  metrics_namespace,
+			MetricData: data[:n],
+		})
+		if err != nil {
+			slog.Warn("Could not publish metrics", "event", "metrics_failed", "error", err.Error())
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// putMetricData sends one batch of metrics, bounded by request_timeout
+func putMetricData(ctx context.Context, svc *cloudwatch.CloudWatch, input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, *request_timeout)
+	defer cancel()
+	return svc.PutMetricDataWithContext(ctx, input)
+}
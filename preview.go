@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+)
+
+// servePreview serves the digest of each feed’s current window on addr as it
+// would be emailed, without sending anything, until it fails
+func servePreview(addr string) error {
+	slog.Info("Serving digest previews", "event", "serve_preview", "addr", addr)
+	return http.ListenAndServe(addr, http.HandlerFunc(handlePreview))
+}
+
+// handlePreview renders the emails of the current window of the feed named by
+// the feed query parameter, the first feed by default. Tweets are read from
+// the store and rendered like emailTweets does.
+func handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	f := previewFeed(r.URL.Query().Get("feed"))
+	if f == nil {
+		http.Error(w, "no such feed", http.StatusNotFound)
+		return
+	}
+
+	current := windowAt(f, clock().In(location))
+	tweets, err := tweetStore.Get(r.Context(), current.key)
+	if err != nil && !errors.Is(err, errNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(tweets) == 0 {
+		http.Error(w, "no tweets stored at "+current.key+" yet", http.StatusNotFound)
+		return
+	}
+
+	emails, err := buildEmails(f, current, tweets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n", html.EscapeString(emails[0].subject))
+	for i, e := range emails {
+		if i > 0 {
+			fmt.Fprint(w, "<hr>\n")
+		}
+		fmt.Fprintf(w, "<p style=\"color: gray; font-family: sans-serif;\">Subject: %s</p>\n%s\n", html.EscapeString(e.subject), e.htmlBody)
+	}
+}
+
+// previewFeed returns the feed with a name, or the first one when it is empty
+func previewFeed(name string) *feed {
+	for _, f := range feeds {
+		if name == "" || f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlePreview(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	feeds = []*feed{{}}
+	tweetStore = fsStore{dir: t.TempDir()}
+
+	rec := httptest.NewRecorder()
+	handlePreview(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("previewing an empty window returned %d, want 404", rec.Code)
+	}
+
+	tweets := []DigestTweet{{ID: 1, FullText: "Previewed tweet", User: &TweetUser{Name: "Alice", ScreenName: "alice"}}}
+	if err := tweetStore.Put(context.Background(), getTodaysKey(feeds[0]), tweets); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handlePreview(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview returned %d: %s", rec.Code, rec.Body)
+	}
+	for _, expected := range []string{"Subject: 1 tweets", "Previewed tweet"} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("preview is missing %q: %s", expected, rec.Body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handlePreview(rec, httptest.NewRequest(http.MethodGet, "/?feed=news", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("previewing an unknown feed returned %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// selfCheck is one check made by selfTest, returning what it found
+type selfCheck struct {
+	name  string
+	check func(context.Context) (string, error)
+}
+
+// selfTest checks that the Twitter credentials, the store and the SES identity
+// work, without fetching tweets or sending email, and reports each check on
+// stdout. It returns whether they all passed.
+func selfTest(ctx context.Context) bool {
+	checks := []selfCheck{
+		{"twitter", checkTwitter},
+		{"store", checkStore},
+	}
+	if outputs["email"] && *mailer == "ses" && !*dry_run {
+		checks = append(checks, selfCheck{"ses", checkSES})
+	}
+
+	passed := true
+	for _, c := range checks {
+		detail, err := c.check(ctx)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			passed = false
+			continue
+		}
+		fmt.Printf("PASS %s: %s\n", c.name, detail)
+	}
+	return passed
+}
+
+// checkTwitter makes a cheap authenticated call to the Twitter API
+func checkTwitter(ctx context.Context) (string, error) {
+	_, client := twitterClient()
+
+	// App-only authentication has no user to verify
+	if *bearer_token != "" {
+		_, _, err := client.RateLimits.Status(&twitter.RateLimitParams{Resources: []string{"lists"}})
+		if err != nil {
+			return "", err
+		}
+		return "bearer token accepted", nil
+	}
+
+	user, _, err := client.Accounts.VerifyCredentials(&twitter.AccountVerifyParams{SkipStatus: twitter.Bool(true)})
+	if err != nil {
+		return "", err
+	}
+	return "authenticated as @" + user.ScreenName, nil
+}
+
+// checkStore writes, reads back and deletes a probe object
+func checkStore(ctx context.Context) (string, error) {
+	key := keyPrefix(&feed{}) + "selftest"
+	probe := time.Now().UnixNano()
+
+	if err := tweetStore.PutTweetID(ctx, key, probe); err != nil {
+		return "", fmt.Errorf("writing %s: %w", key, err)
+	}
+	got, err := tweetStore.GetTweetID(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", key, err)
+	}
+	if got != probe {
+		return "", fmt.Errorf("read %d back from %s, want %d", got, key, probe)
+	}
+	if err := tweetStore.Delete(ctx, key); err != nil {
+		return "", fmt.Errorf("deleting %s: %w", key, err)
+	}
+	return "wrote, read and deleted " + key, nil
+}
+
+// checkSES checks that SES verified the from address or its domain
+func checkSES(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, *request_timeout)
+	defer cancel()
+
+	address, err := mail.ParseAddress(*from)
+	if err != nil {
+		return "", err
+	}
+	domain := address.Address[strings.LastIndex(address.Address, "@")+1:]
+	identities := []string{address.Address, domain}
+
+	result, err := sesClient().GetIdentityVerificationAttributesWithContext(ctx, &ses.GetIdentityVerificationAttributesInput{
+		Identities: aws.StringSlice(identities),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var statuses []string
+	for _, identity := range identities {
+		status := "not found"
+		if attributes, ok := result.VerificationAttributes[identity]; ok {
+			status = aws.StringValue(attributes.VerificationStatus)
+		}
+		if status == ses.VerificationStatusSuccess {
+			return identity + " is verified", nil
+		}
+		statuses = append(statuses, identity+": "+status)
+	}
+	return "", fmt.Errorf("from address isn’t verified: %s", strings.Join(statuses, ", "))
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStore(t *testing.T) {
+	defineConfig()
+	dir := t.TempDir()
+	tweetStore = fsStore{dir: dir}
+
+	if _, err := checkStore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tweets", "selftest")); !os.IsNotExist(err) {
+		t.Errorf("probe object was left behind: %v", err)
+	}
+}
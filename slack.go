@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxSlackBlocks is the most blocks Slack accepts in one message
+const maxSlackBlocks = 50
+
+// maxSlackText is the most characters Slack accepts in a section’s text
+const maxSlackText = 3000
+
+// slackMessage is a Slack Block Kit message. Text is shown in notifications.
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type      string      `json:"type"`
+	Text      *slackText  `json:"text,omitempty"`
+	Accessory *slackImage `json:"accessory,omitempty"`
+	ImageURL  string      `json:"image_url,omitempty"`
+	AltText   string      `json:"alt_text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackImage struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+// postSlack posts tweets oldest first to the slack-webhook-url incoming
+// webhook, in as many messages as Slack’s block limit requires
+func postSlack(ctx context.Context, tweets []DigestTweet) error {
+	messages := buildSlackMessages(sortTweets(dedupTweets(tweets)))
+	for i, message := range messages {
+		slog.Info("Posting to Slack", "event", "post_slack", "message", i+1, "messages", len(messages), "blocks", len(message.Blocks))
+		if err := postSlackMessage(ctx, message); err != nil {
+			return fmt.Errorf("message %d/%d: %w", i+1, len(messages), err)
+		}
+	}
+	return nil
+}
+
+// buildSlackMessages renders tweets as Slack messages, starting a new one
+// before a tweet’s blocks would go over maxSlackBlocks
+func buildSlackMessages(tweets []DigestTweet) []slackMessage {
+	var messages []slackMessage
+	var message slackMessage
+	for i := range tweets {
+		data := newCardData(&tweets[i])
+		blocks := slackBlocks(data)
+		if len(message.Blocks)+len(blocks) > maxSlackBlocks {
+			messages = append(messages, message)
+			message = slackMessage{}
+		}
+		if message.Text == "" && data.Unavailable {
+			message.Text = data.PlainText
+		} else if message.Text == "" {
+			message.Text = fmt.Sprintf("%s (@%s): %s", data.Name, data.ScreenName, data.PlainText)
+		}
+		message.Blocks = append(message.Blocks, blocks...)
+	}
+	if len(message.Blocks) > 0 {
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// slackBlocks renders a tweet as a section with its author, text and link,
+// followed by its photos and a divider
+func slackBlocks(data cardData) []slackBlock {
+	if data.Unavailable {
+		text := fmt.Sprintf("_%s_\n<%s|View tweet>", slackEscape(data.PlainText), data.URL)
+		return []slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}, {Type: "divider"}}
+	}
+
+	text := strings.Builder{}
+	if data.RetweetedBy != "" {
+		text.WriteString(fmt.Sprintf("_%s_\n", slackEscape(data.RetweetedText)))
+	}
+	text.WriteString(fmt.Sprintf("*%s* <%s|@%s>", slackEscape(data.Name), data.ProfileURL, slackEscape(data.ScreenName)))
+	if data.Time != "" {
+		text.WriteString(fmt.Sprintf(" · <%s|%s>", data.URL, slackEscape(data.Time)))
+	}
+	text.WriteString("\n" + slackEscape(data.PlainText))
+	text.WriteString(fmt.Sprintf("\n<%s|View tweet>", data.URL))
+
+	section := slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: truncateRunes(text.String(), maxSlackText)}}
+	if data.Avatar != "" {
+		section.Accessory = &slackImage{Type: "image", ImageURL: data.Avatar, AltText: data.Name}
+	}
+
+	blocks := []slackBlock{section}
+	for _, photo := range data.Photos {
+		blocks = append(blocks, slackBlock{Type: "image", ImageURL: photo, AltText: "Photo"})
+	}
+	return append(blocks, slackBlock{Type: "divider"})
+}
+
+// slackEscape escapes the characters Slack treats as control characters in
+// mrkdwn text
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// truncateRunes shortens text to at most n characters, ending with an
+// ellipsis when it was cut
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// postSlackMessage posts a message to the webhook, bounded by request_timeout
+func postSlackMessage(ctx context.Context, message slackMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *request_timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, *slack_webhook_url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("slack webhook returned %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
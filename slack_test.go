@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildSlackMessages(t *testing.T) {
+	defineConfig()
+
+	photo := MediaEntity{Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/cat.jpg"}
+	var tweets []DigestTweet
+	for id := int64(1); id <= 20; id++ {
+		tweets = append(tweets, DigestTweet{
+			ID:               id,
+			FullText:         "a <b> & c",
+			User:             &TweetUser{Name: "Alice", ScreenName: "alice", ProfileImageURLHttps: "https://pbs.twimg.com/alice_normal.jpg"},
+			ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{photo}},
+		})
+	}
+
+	// Each tweet takes a section, an image and a divider
+	messages := buildSlackMessages(tweets)
+	if len(messages) != 2 || len(messages[0].Blocks) != 48 || len(messages[1].Blocks) != 12 {
+		t.Fatalf("Expected messages of 48 and 12 blocks, got %d messages", len(messages))
+	}
+
+	section := messages[0].Blocks[0]
+	if !strings.Contains(section.Text.Text, "*Alice* <https://twitter.com/alice|@alice>\na &lt;b&gt; &amp; c\n<https://twitter.com/alice/status/1|View tweet>") {
+		t.Errorf("Section text is %q", section.Text.Text)
+	}
+	if section.Accessory == nil || section.Accessory.ImageURL != "https://pbs.twimg.com/alice_reasonably_small.jpg" {
+		t.Errorf("Section accessory is %+v", section.Accessory)
+	}
+	if image := messages[0].Blocks[1]; image.Type != "image" || image.ImageURL != photo.MediaURLHttps {
+		t.Errorf("Second block is %+v, want the photo", image)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// errNotFound is returned by a Store when nothing is stored at a key
+var errNotFound = errors.New("key not found")
+
+// Store keeps the tweets of each window under keys, along with tweet IDs
+// tracking what was fetched and emailed so far
+type Store interface {
+	// Get returns the tweets stored at key, or errNotFound
+	Get(ctx context.Context, key string) ([]DigestTweet, error)
+	// Put stores tweets at key, replacing what was there
+	Put(ctx context.Context, key string, tweets []DigestTweet) error
+	// Merge adds tweets before those stored at key, without losing tweets
+	// another run merged at the same time
+	Merge(ctx context.Context, key string, tweets []DigestTweet) error
+	// GetTweetID returns the tweet ID stored at key, or 0 if none was stored
+	GetTweetID(ctx context.Context, key string) (int64, error)
+	// PutTweetID stores a tweet ID at key
+	PutTweetID(ctx context.Context, key string, id int64) error
+	// PutObject stores data of a content type at key, for outputs like the
+	// Atom feed
+	PutObject(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete removes what is stored at key
+	Delete(ctx context.Context, key string) error
+}
+
+// newStore returns the Store selected by the store option. A bucket of the
+// form file://<dir> selects the fs store in that directory.
+func newStore() (Store, error) {
+	if strings.HasPrefix(*bucket, "file://") {
+		return fsStore{dir: strings.TrimPrefix(*bucket, "file://")}, nil
+	}
+
+	switch *store {
+	case "s3":
+		return s3Store{bucket: *bucket, svc: s3.New(sess, s3Config())}, nil
+	case "fs":
+		return fsStore{dir: *store_dir}, nil
+	default:
+		return nil, fmt.Errorf("invalid store %q: must be s3 or fs", *store)
+	}
+}
+
+// schemaVersion is the version of the JSON tweets are stored as
+const schemaVersion = 1
+
+// storedTweets is the JSON tweets are stored as, so that the format can
+// change. Version 0 is a bare array of tweets, as stored before versions.
+type storedTweets struct {
+	SchemaVersion int           `json:"schema_version"`
+	Tweets        []DigestTweet `json:"tweets"`
+}
+
+// decodeTweets decodes stored tweets according to their schema version
+func decodeTweets(data []byte) ([]DigestTweet, error) {
+	var tweets []DigestTweet
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) || bytes.Equal(trimmed, []byte("null")) {
+		err := json.Unmarshal(data, &tweets)
+		return tweets, err
+	}
+
+	var stored storedTweets
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	switch stored.SchemaVersion {
+	case 1:
+		return stored.Tweets, nil
+	default:
+		return nil, fmt.Errorf("unsupported schema_version %d of stored tweets", stored.SchemaVersion)
+	}
+}
+
+// s3Config returns the S3 client configuration, targeting s3-endpoint when it
+// is set, for S3-compatible services like localstack or MinIO
+func s3Config() *aws.Config {
+	config := aws.NewConfig()
+	if *s3_endpoint != "" {
+		config = config.WithEndpoint(*s3_endpoint)
+	}
+	if *s3_force_path_style {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	return config
+}
+
+// s3Store keeps gzipped JSON objects in an S3 bucket. Each attempt at a call is
+// bounded by request_timeout, and transient failures are retried.
+type s3Store struct {
+	bucket string
+	svc    *s3.S3
+}
+
+func (s s3Store) Get(ctx context.Context, key string) ([]DigestTweet, error) {
+	tweets, _, err := s.get(ctx, key)
+	return tweets, err
+}
+
+// get returns the tweets stored at key along with the object’s ETag
+func (s s3Store) get(ctx context.Context, key string) ([]DigestTweet, string, error) {
+	defer recordLatency("S3ReadLatency", time.Now())
+	slog.Debug("Getting tweets", "event", "get_tweets", "bucket", s.bucket, "key", key)
+	data, etag, err := s.getObject(ctx, key)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", errNotFound
+		}
+		return nil, "", s.describeError(err, "s3:GetObject", key)
+	}
+
+	// Go’s HTTP transport transparently decompresses responses served with
+	// Content-Encoding: gzip and drops the header, so sniff the body instead.
+	// Objects stored before compression was added are plain JSON.
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		defer gz.Close()
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	tweets, err := decodeTweets(data)
+	return tweets, etag, err
+}
+
+// getObject reads the object at key along with its ETag, retrying transient
+// failures. Reading the body is part of each attempt.
+func (s s3Store) getObject(ctx context.Context, key string) ([]byte, string, error) {
+	var data []byte
+	var etag string
+	err := retryAWS(ctx, "s3:GetObject", func(ctx context.Context) error {
+		result, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		defer result.Body.Close()
+
+		etag = aws.StringValue(result.ETag)
+		data, err = io.ReadAll(result.Body)
+		if err != nil {
+			return awserr.New(request.ErrCodeRead, "reading "+key, err)
+		}
+		return nil
+	})
+	return data, etag, err
+}
+
+// Content types of the objects the store writes. Tweets are also
+// gzip-encoded.
+const (
+	jsonContentType    = "application/json; charset=utf-8"
+	tweetIDContentType = "text/plain; charset=utf-8"
+)
+
+// upload uploads data at key, retrying transient failures
+func (s s3Store) upload(ctx context.Context, key string, data []byte, configure func(*s3manager.UploadInput)) error {
+	uploader := s3manager.NewUploaderWithClient(s.svc)
+	err := retryAWS(ctx, "s3:PutObject", func(ctx context.Context) error {
+		input := s.uploadInput(key, bytes.NewReader(data))
+		if configure != nil {
+			configure(input)
+		}
+		_, err := uploader.UploadWithContext(ctx, input)
+		return err
+	})
+	return s.describeError(err, "s3:PutObject", key)
+}
+
+func (s s3Store) Put(ctx context.Context, key string, tweets []DigestTweet) error {
+	defer recordLatency("S3WriteLatency", time.Now())
+	buf, err := gzipTweets(tweets)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Uploading tweets", "event", "upload_tweets", "bucket", s.bucket, "key", key, "count", len(tweets))
+	return s.upload(ctx, key, buf.Bytes(), func(input *s3manager.UploadInput) {
+		input.ContentType = aws.String(jsonContentType)
+		input.ContentEncoding = aws.String("gzip")
+	})
+}
+
+// Merge reads the stored tweets along with their ETag, and only writes the
+// merged tweets back if the object wasn’t changed in the meantime. Otherwise
+// it starts over, up to store_retries times.
+func (s s3Store) Merge(ctx context.Context, key string, tweets []DigestTweet) error {
+	for attempt := 0; ; attempt++ {
+		stored, etag, err := s.get(ctx, key)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+
+		err = s.putIfMatch(ctx, key, mergeTweets(tweets, stored), etag)
+		if !isPreconditionFailed(err) || attempt >= *store_retries {
+			return err
+		}
+		slog.Warn("Tweets changed while merging, retrying", "event", "merge_retry", "bucket", s.bucket, "key", key, "attempt", attempt+1, "retries", *store_retries)
+	}
+}
+
+// putIfMatch stores tweets at key only if the object there still has etag, or
+// if there is no object there when etag is empty
+func (s s3Store) putIfMatch(ctx context.Context, key string, tweets []DigestTweet, etag string) error {
+	defer recordLatency("S3WriteLatency", time.Now())
+	buf, err := gzipTweets(tweets)
+	if err != nil {
+		return err
+	}
+
+	// The SDK predates conditional writes, so set the headers by hand
+	header, value := "If-Match", etag
+	if etag == "" {
+		header, value = "If-None-Match", "*"
+	}
+
+	slog.Info("Uploading tweets", "event", "upload_tweets", "bucket", s.bucket, "key", key, "count", len(tweets), "condition", header)
+	err = retryAWS(ctx, "s3:PutObject", func(ctx context.Context) error {
+		input := &s3.PutObjectInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			Body:            bytes.NewReader(buf.Bytes()),
+			ContentType:     aws.String(jsonContentType),
+			ContentEncoding: aws.String("gzip"),
+		}
+		if *s3_sse != "" {
+			input.ServerSideEncryption = aws.String(*s3_sse)
+		}
+		if *s3_kms_key_id != "" {
+			input.SSEKMSKeyId = aws.String(*s3_kms_key_id)
+		}
+		_, err := s.svc.PutObjectWithContext(ctx, input, func(r *request.Request) {
+			r.HTTPRequest.Header.Set(header, value)
+		})
+		return err
+	})
+	return s.describeError(err, "s3:PutObject", key)
+}
+
+// isPreconditionFailed reports whether a conditional write failed because
+// another writer got there first
+func isPreconditionFailed(err error) bool {
+	var aerr awserr.RequestFailure
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	return aerr.StatusCode() == http.StatusPreconditionFailed || aerr.StatusCode() == http.StatusConflict
+}
+
+// gzipTweets returns tweets as gzipped JSON
+func gzipTweets(tweets []DigestTweet) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer([]byte{})
+	gz := gzip.NewWriter(buf)
+	err := encodeTweets(gz, tweets)
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// encodeTweets writes tweets as the JSON they are stored as, indented when
+// pretty_store is set
+func encodeTweets(w io.Writer, tweets []DigestTweet) error {
+	encoder := json.NewEncoder(w)
+	if *pretty_store {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(storedTweets{SchemaVersion: schemaVersion, Tweets: tweets})
+}
+
+// mergeTweets returns tweets followed by the stored ones, without duplicates
+func mergeTweets(tweets, stored []DigestTweet) []DigestTweet {
+	merged := make([]DigestTweet, 0, len(tweets)+len(stored))
+	merged = append(merged, tweets...)
+	return dedupTweets(append(merged, stored...))
+}
+
+func (s s3Store) GetTweetID(ctx context.Context, key string) (int64, error) {
+	defer recordLatency("S3ReadLatency", time.Now())
+	body, _, err := s.getObject(ctx, key)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			slog.Info("Tweet ID not found", "event", "tweet_id_not_found", "bucket", s.bucket, "key", key)
+			return 0, nil
+		}
+		return 0, s.describeError(err, "s3:GetObject", key)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+func (s s3Store) PutTweetID(ctx context.Context, key string, id int64) error {
+	defer recordLatency("S3WriteLatency", time.Now())
+	slog.Debug("Uploading tweet ID", "event", "upload_tweet_id", "bucket", s.bucket, "key", key, "id", id)
+	return s.upload(ctx, key, []byte(strconv.FormatInt(id, 10)), func(input *s3manager.UploadInput) {
+		input.ContentType = aws.String(tweetIDContentType)
+	})
+}
+
+func (s s3Store) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	defer recordLatency("S3WriteLatency", time.Now())
+	slog.Info("Uploading object", "event", "upload_object", "bucket", s.bucket, "key", key, "content_type", contentType)
+	return s.upload(ctx, key, data, func(input *s3manager.UploadInput) {
+		input.ContentType = aws.String(contentType)
+	})
+}
+
+// PresignGet returns a URL reading key without credentials, which stays
+// valid for expiry unless the credentials signing it expire first
+func (s s3Store) PresignGet(key string, expiry time.Duration) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expiry)
+}
+
+// ObjectURL returns the URL of key without a signature, which only reads it
+// if the bucket policy lets anyone do so
+func (s s3Store) ObjectURL(key string) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err := req.Build(); err != nil {
+		return "", err
+	}
+	return req.HTTPRequest.URL.String(), nil
+}
+
+func (s s3Store) Delete(ctx context.Context, key string) error {
+	slog.Debug("Deleting object", "event", "delete_object", "bucket", s.bucket, "key", key)
+	err := retryAWS(ctx, "s3:DeleteObject", func(ctx context.Context) error {
+		_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	return s.describeError(err, "s3:DeleteObject", key)
+}
+
+// describeError explains the errors S3 returns for a missing bucket or
+// missing permissions, which are easy to get wrong when setting up. action is
+// the permission the call needed on key.
+func (s s3Store) describeError(err error, action, key string) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchBucket:
+		return fmt.Errorf("bucket %s not found in region %s, create it or check the bucket and AWS_REGION settings: %w", s.bucket, aws.StringValue(s.svc.Config.Region), err)
+	case "AccessDenied":
+		// Without s3:ListBucket, S3 reports missing keys as denied too
+		return fmt.Errorf("access denied: the role lacks %s on arn:aws:s3:::%s/%s, or s3:ListBucket on the bucket: %w", action, s.bucket, key, err)
+	default:
+		return err
+	}
+}
+
+// uploadInput returns the input to upload body at key, encrypted as set by
+// s3-sse and s3-kms-key-id
+func (s s3Store) uploadInput(key string, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if *s3_sse != "" {
+		input.ServerSideEncryption = aws.String(*s3_sse)
+	}
+	if *s3_kms_key_id != "" {
+		input.SSEKMSKeyId = aws.String(*s3_kms_key_id)
+	}
+	return input
+}
+
+// fsStore keeps plain JSON files under a directory, one per key, for local
+// development
+type fsStore struct {
+	dir string
+}
+
+// path returns the file a key is stored in
+func (s fsStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s fsStore) Get(ctx context.Context, key string) ([]DigestTweet, error) {
+	slog.Debug("Reading tweets", "event", "get_tweets", "dir", s.dir, "key", key)
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	return decodeTweets(data)
+}
+
+func (s fsStore) Put(ctx context.Context, key string, tweets []DigestTweet) error {
+	buf := bytes.Buffer{}
+	if err := encodeTweets(&buf, tweets); err != nil {
+		return err
+	}
+
+	slog.Info("Writing tweets", "event", "upload_tweets", "dir", s.dir, "key", key, "count", len(tweets))
+	return s.write(key, buf.Bytes())
+}
+
+func (s fsStore) Merge(ctx context.Context, key string, tweets []DigestTweet) error {
+	stored, err := s.Get(ctx, key)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	return s.Put(ctx, key, mergeTweets(tweets, stored))
+}
+
+func (s fsStore) GetTweetID(ctx context.Context, key string) (int64, error) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			slog.Info("Tweet ID not found", "event", "tweet_id_not_found", "dir", s.dir, "key", key)
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s fsStore) PutTweetID(ctx context.Context, key string, id int64) error {
+	slog.Debug("Writing tweet ID", "event", "upload_tweet_id", "dir", s.dir, "key", key, "id", id)
+	return s.write(key, []byte(strconv.FormatInt(id, 10)))
+}
+
+func (s fsStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	slog.Info("Writing object", "event", "upload_object", "dir", s.dir, "key", key, "content_type", contentType)
+	return s.write(key, data)
+}
+
+func (s fsStore) Delete(ctx context.Context, key string) error {
+	slog.Debug("Deleting file", "event", "delete_object", "dir", s.dir, "key", key)
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// write stores data at key, creating the directories it is in
+func (s fsStore) write(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestFSStore(t *testing.T) {
+	defineConfig()
+	ctx := context.Background()
+	s := fsStore{dir: t.TempDir()}
+
+	if _, err := s.Get(ctx, "tweets/2020-01-02-0/tweets.json"); !errors.Is(err, errNotFound) {
+		t.Fatalf("Get of a missing key returned %v, want errNotFound", err)
+	}
+
+	tweets := []DigestTweet{{ID: 2, FullText: "second"}, {ID: 1, FullText: "first"}}
+	if err := s.Put(ctx, "tweets/2020-01-02-0/tweets.json", tweets); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctx, "tweets/2020-01-02-0/tweets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != 2 || got[1].FullText != "first" {
+		t.Errorf("Get returned %+v, want %+v", got, tweets)
+	}
+
+	sinceID, err := s.GetTweetID(ctx, "tweets/since_id")
+	if err != nil || sinceID != 0 {
+		t.Fatalf("GetTweetID of a missing key returned %d, %v, want 0, nil", sinceID, err)
+	}
+	if err := s.PutTweetID(ctx, "tweets/since_id", 1234); err != nil {
+		t.Fatal(err)
+	}
+	sinceID, err = s.GetTweetID(ctx, "tweets/since_id")
+	if err != nil || sinceID != 1234 {
+		t.Errorf("GetTweetID returned %d, %v, want 1234, nil", sinceID, err)
+	}
+}
+
+func TestPrettyStore(t *testing.T) {
+	defineConfig()
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := fsStore{dir: dir}
+	tweets := []DigestTweet{{ID: 2, FullText: "second"}, {ID: 1, FullText: "first"}}
+
+	for _, pretty := range []bool{false, true} {
+		*pretty_store = pretty
+		if err := s.Put(ctx, "tweets.json", tweets); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "tweets.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if indented := strings.Contains(string(data), "\n  \""); indented != pretty {
+			t.Errorf("with pretty-store %t, tweets were stored as %s", pretty, data)
+		}
+		got, err := s.Get(ctx, "tweets.json")
+		if err != nil || len(got) != 2 || got[1].FullText != "first" {
+			t.Errorf("with pretty-store %t, Get returned %+v, %v", pretty, got, err)
+		}
+	}
+}
+
+func TestS3StoreUploadInputEncryption(t *testing.T) {
+	defineConfig()
+	s := s3Store{bucket: "bucket"}
+
+	input := s.uploadInput("tweets/since_id", nil)
+	if input.ServerSideEncryption != nil || input.SSEKMSKeyId != nil {
+		t.Errorf("upload input is encrypted by default: %v, %v", input.ServerSideEncryption, input.SSEKMSKeyId)
+	}
+
+	*s3_sse = "aws:kms"
+	*s3_kms_key_id = "alias/tweets"
+	input = s.uploadInput("tweets/since_id", nil)
+	if input.ServerSideEncryption == nil || *input.ServerSideEncryption != "aws:kms" {
+		t.Errorf("ServerSideEncryption = %v, want aws:kms", input.ServerSideEncryption)
+	}
+	if input.SSEKMSKeyId == nil || *input.SSEKMSKeyId != "alias/tweets" {
+		t.Errorf("SSEKMSKeyId = %v, want alias/tweets", input.SSEKMSKeyId)
+	}
+}
+
+func TestS3StoreMergeRetries(t *testing.T) {
+	defineConfig()
+	var gets, puts int
+	var stored []DigestTweet
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			gets++
+			// Another run merges tweet 2 between the first read and write
+			tweets := []DigestTweet{{ID: 1}}
+			if gets > 1 {
+				tweets = []DigestTweet{{ID: 2}, {ID: 1}}
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"%d"`, gets))
+			json.NewEncoder(w).Encode(tweets)
+		case http.MethodPut:
+			puts++
+			if want := fmt.Sprintf(`"%d"`, gets); r.Header.Get("If-Match") != want {
+				t.Errorf("If-Match = %q, want %q", r.Header.Get("If-Match"), want)
+			}
+			if puts == 1 {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err = decodeTweets(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	s := testS3Store(srv.URL)
+
+	if err := s.Merge(context.Background(), "tweets/2020-01-02-0/tweets.json", []DigestTweet{{ID: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 2 || puts != 2 {
+		t.Errorf("Merge made %d gets and %d puts, want 2 and 2", gets, puts)
+	}
+	if len(stored) != 3 || stored[0].ID != 3 || stored[1].ID != 2 || stored[2].ID != 1 {
+		t.Errorf("Merge stored %+v, want tweets 3, 2 and 1", stored)
+	}
+}
+
+func TestS3StoreContentTypes(t *testing.T) {
+	defineConfig()
+	headers := map[string]http.Header{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[strings.TrimPrefix(r.URL.Path, "/bucket/")] = r.Header
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+		}
+	}))
+	defer srv.Close()
+
+	s := testS3Store(srv.URL)
+	ctx := context.Background()
+	if err := s.Put(ctx, "tweets/put/tweets.json", []DigestTweet{{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Merge(ctx, "tweets/merge/tweets.json", []DigestTweet{{ID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutTweetID(ctx, "tweets/since_id", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutObject(ctx, "tweets/feed.atom", nil, "application/atom+xml"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][2]string{
+		"tweets/put/tweets.json":   {jsonContentType, "gzip"},
+		"tweets/merge/tweets.json": {jsonContentType, "gzip"},
+		"tweets/since_id":          {tweetIDContentType, ""},
+		"tweets/feed.atom":         {"application/atom+xml", ""},
+	} {
+		header := headers[key]
+		if got := [2]string{header.Get("Content-Type"), header.Get("Content-Encoding")}; got != want {
+			t.Errorf("%s was uploaded with content type and encoding %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestS3StorePresignGet(t *testing.T) {
+	s := testS3Store("https://s3.example.com")
+
+	url, err := s.PresignGet("tweets/media/1/0", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"https://s3.example.com/bucket/tweets/media/1/0?", "X-Amz-Expires=3600", "X-Amz-Signature="} {
+		if !strings.Contains(url, expected) {
+			t.Errorf("presigned URL %s is missing %q", url, expected)
+		}
+	}
+}
+
+func TestS3StoreObjectURL(t *testing.T) {
+	s := testS3Store("https://s3.example.com")
+
+	url, err := s.ObjectURL("tweets/media/1/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://s3.example.com/bucket/tweets/media/1/0" {
+		t.Errorf("object URL is %s", url)
+	}
+}
+
+func TestDecodeTweets(t *testing.T) {
+	tweets := []DigestTweet{{ID: 2, FullText: "second"}, {ID: 1, FullText: "first"}}
+	current, err := json.Marshal(storedTweets{SchemaVersion: schemaVersion, Tweets: tweets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare, err := json.Marshal(tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"current": current, "bare array": bare} {
+		got, err := decodeTweets(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(got) != 2 || got[0].ID != 2 || got[1].FullText != "first" {
+			t.Errorf("%s: decoded %+v, want %+v", name, got, tweets)
+		}
+	}
+
+	if got, err := decodeTweets([]byte("null")); err != nil || len(got) != 0 {
+		t.Errorf("null decoded to %+v, %v", got, err)
+	}
+	if _, err := decodeTweets([]byte(`{"schema_version": 99, "tweets": []}`)); err == nil {
+		t.Error("an unknown schema version decoded")
+	}
+}
+
+// testS3Store returns an s3Store for a bucket served by a test server
+func testS3Store(endpoint string) s3Store {
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithEndpoint(endpoint).
+		WithS3ForcePathStyle(true).
+		WithMaxRetries(0)))
+	return s3Store{bucket: "bucket", svc: s3.New(sess)}
+}
+
+func TestS3StoreDescribesSetupErrors(t *testing.T) {
+	defineConfig()
+	tests := []struct {
+		status int
+		code   string
+		want   string
+	}{
+		{http.StatusNotFound, "NoSuchBucket", "bucket bucket not found in region us-east-1"},
+		{http.StatusForbidden, "AccessDenied", "the role lacks s3:GetObject on arn:aws:s3:::bucket/tweets/since_id"},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", test.code, test.code)
+		}))
+		_, err := testS3Store(srv.URL).GetTweetID(context.Background(), "tweets/since_id")
+		srv.Close()
+
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error is %v, want it to say %q", test.code, err, test.want)
+		}
+	}
+}
+
+func TestS3StoreRetriesTransientErrors(t *testing.T) {
+	defineConfig()
+	*aws_max_backoff = time.Millisecond
+
+	tests := []struct {
+		status   int
+		code     string
+		failures int
+		requests int
+		succeeds bool
+	}{
+		{http.StatusServiceUnavailable, "SlowDown", 2, 3, true},
+		{http.StatusInternalServerError, "InternalError", 5, 4, false},
+		{http.StatusBadRequest, "Throttling", 1, 2, true},
+		{http.StatusForbidden, "AccessDenied", 5, 1, false},
+		{http.StatusNotFound, "NoSuchKey", 5, 1, true},
+	}
+	for _, test := range tests {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= test.failures {
+				w.WriteHeader(test.status)
+				fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", test.code, test.code)
+				return
+			}
+			fmt.Fprint(w, "1234")
+		}))
+		_, err := testS3Store(srv.URL).GetTweetID(context.Background(), "tweets/since_id")
+		srv.Close()
+
+		if requests != test.requests {
+			t.Errorf("%s: made %d requests, want %d", test.code, requests, test.requests)
+		}
+		if (err == nil) != test.succeeds {
+			t.Errorf("%s: error is %v", test.code, err)
+		}
+	}
+
+	if isRetryableAWS(errors.New("not from AWS")) {
+		t.Error("an error that isn’t from AWS is retryable")
+	}
+}
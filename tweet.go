@@ -0,0 +1,226 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+// DigestTweet is a tweet as it is stored and rendered, with only the fields
+// the digest uses. Tweets are converted to it when they are fetched, whatever
+// the API version. Its JSON matches the v1.1 API’s, so tweets stored before
+// it was introduced still load.
+type DigestTweet struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+	// FullText is empty for tweets fetched without extended mode, whose Text
+	// may be truncated
+	Text     string     `json:"text,omitempty"`
+	FullText string     `json:"full_text,omitempty"`
+	User     *TweetUser `json:"user"`
+	// DisplayTextRange is the part of the text Twitter displays, in
+	// characters. Only the v1.1 API reports it.
+	DisplayTextRange *Indices `json:"display_text_range,omitempty"`
+
+	Entities         *TweetEntities    `json:"entities,omitempty"`
+	ExtendedEntities *ExtendedEntities `json:"extended_entities,omitempty"`
+
+	InReplyToStatusID   int64  `json:"in_reply_to_status_id,omitempty"`
+	InReplyToUserID     int64  `json:"in_reply_to_user_id,omitempty"`
+	InReplyToScreenName string `json:"in_reply_to_screen_name,omitempty"`
+
+	FavoriteCount int `json:"favorite_count,omitempty"`
+	RetweetCount  int `json:"retweet_count,omitempty"`
+
+	RetweetedStatus *DigestTweet `json:"retweeted_status,omitempty"`
+	QuotedStatusID  int64        `json:"quoted_status_id,omitempty"`
+	QuotedStatus    *DigestTweet `json:"quoted_status,omitempty"`
+
+	// EditHistoryTweetIDs are the IDs of every version of an edited tweet,
+	// oldest first. Only the v2 API reports them.
+	EditHistoryTweetIDs []int64 `json:"edit_history_tweet_ids,omitempty"`
+}
+
+// CreatedAtTime returns when a tweet was posted
+func (t DigestTweet) CreatedAtTime() (time.Time, error) {
+	return time.Parse(time.RubyDate, t.CreatedAt)
+}
+
+// InitialID returns the ID of the first version of a tweet, which all its
+// edits share
+func (t DigestTweet) InitialID() int64 {
+	if len(t.EditHistoryTweetIDs) > 0 {
+		return t.EditHistoryTweetIDs[0]
+	}
+	return t.ID
+}
+
+// Edited reports whether a tweet is an edit of an earlier version
+func (t DigestTweet) Edited() bool {
+	return t.InitialID() != t.ID
+}
+
+// Unavailable reports whether a tweet, or the tweet it retweets, came
+// without its author, as tweets that were deleted or whose author was
+// suspended can
+func (t DigestTweet) Unavailable() bool {
+	return t.User == nil || t.RetweetedStatus != nil && t.RetweetedStatus.User == nil
+}
+
+// TweetUser is the author of a tweet
+type TweetUser struct {
+	ID                   int64  `json:"id"`
+	Name                 string `json:"name"`
+	ScreenName           string `json:"screen_name"`
+	ProfileImageURLHttps string `json:"profile_image_url_https"`
+}
+
+// TweetEntities are the links, hashtags, mentions and media in the text of a
+// tweet
+type TweetEntities struct {
+	Hashtags     []HashtagEntity `json:"hashtags,omitempty"`
+	Media        []MediaEntity   `json:"media,omitempty"`
+	Urls         []URLEntity     `json:"urls,omitempty"`
+	UserMentions []MentionEntity `json:"user_mentions,omitempty"`
+}
+
+// ExtendedEntities are all the media of a tweet, when Entities only has the
+// first
+type ExtendedEntities struct {
+	Media []MediaEntity `json:"media,omitempty"`
+}
+
+// Indices are where an entity starts and ends in the text of a tweet. Twitter
+// counts Unicode code points, so they index into the text as runes, not bytes
+// or UTF-16 code units.
+type Indices [2]int
+
+// Start returns the index at which an entity starts, inclusive
+func (i Indices) Start() int {
+	return i[0]
+}
+
+// End returns the index at which an entity ends, exclusive
+func (i Indices) End() int {
+	return i[1]
+}
+
+// HashtagEntity is a hashtag in the text of a tweet
+type HashtagEntity struct {
+	Indices Indices `json:"indices"`
+	Text    string  `json:"text"`
+}
+
+// MentionEntity is a mention of a user in the text of a tweet
+type MentionEntity struct {
+	Indices    Indices `json:"indices"`
+	ScreenName string  `json:"screen_name"`
+}
+
+// URLEntity is a t.co link in the text of a tweet
+type URLEntity struct {
+	Indices     Indices `json:"indices"`
+	DisplayURL  string  `json:"display_url"`
+	ExpandedURL string  `json:"expanded_url"`
+	URL         string  `json:"url"`
+}
+
+// MediaEntity is a photo, video or animated GIF attached to a tweet, and the
+// t.co link to it in its text
+type MediaEntity struct {
+	URLEntity
+	MediaURL      string    `json:"media_url,omitempty"`
+	MediaURLHttps string    `json:"media_url_https"`
+	Type          string    `json:"type"`
+	VideoInfo     VideoInfo `json:"video_info"`
+	// MirrorKey is where the image was copied to in the store by
+	// mirror-media
+	MirrorKey string `json:"mirror_key,omitempty"`
+}
+
+// VideoInfo describes the video of a video or animated GIF
+type VideoInfo struct {
+	DurationMillis int            `json:"duration_millis,omitempty"`
+	Variants       []VideoVariant `json:"variants,omitempty"`
+}
+
+// VideoVariant is one of the formats a video is available in
+type VideoVariant struct {
+	ContentType string `json:"content_type"`
+	Bitrate     int    `json:"bitrate,omitempty"`
+	URL         string `json:"url"`
+}
+
+// newDigestTweet converts a tweet from the v1.1 API
+func newDigestTweet(tweet *twitter.Tweet) *DigestTweet {
+	if tweet == nil {
+		return nil
+	}
+
+	digest := &DigestTweet{
+		ID:                  tweet.ID,
+		CreatedAt:           tweet.CreatedAt,
+		Text:                tweet.Text,
+		FullText:            tweet.FullText,
+		InReplyToStatusID:   tweet.InReplyToStatusID,
+		InReplyToUserID:     tweet.InReplyToUserID,
+		InReplyToScreenName: tweet.InReplyToScreenName,
+		FavoriteCount:       tweet.FavoriteCount,
+		RetweetCount:        tweet.RetweetCount,
+		RetweetedStatus:     newDigestTweet(tweet.RetweetedStatus),
+		QuotedStatusID:      tweet.QuotedStatusID,
+		QuotedStatus:        newDigestTweet(tweet.QuotedStatus),
+	}
+	displayTextRange := Indices(tweet.DisplayTextRange)
+	digest.DisplayTextRange = &displayTextRange
+	if u := tweet.User; u != nil {
+		digest.User = &TweetUser{ID: u.ID, Name: u.Name, ScreenName: u.ScreenName, ProfileImageURLHttps: u.ProfileImageURLHttps}
+	}
+	if e := tweet.Entities; e != nil {
+		digest.Entities = &TweetEntities{Media: newMediaEntities(e.Media)}
+		for _, h := range e.Hashtags {
+			digest.Entities.Hashtags = append(digest.Entities.Hashtags, HashtagEntity{Indices: Indices(h.Indices), Text: h.Text})
+		}
+		for _, u := range e.Urls {
+			digest.Entities.Urls = append(digest.Entities.Urls, newURLEntity(u))
+		}
+		for _, m := range e.UserMentions {
+			digest.Entities.UserMentions = append(digest.Entities.UserMentions, MentionEntity{Indices: Indices(m.Indices), ScreenName: m.ScreenName})
+		}
+	}
+	if e := tweet.ExtendedEntities; e != nil {
+		digest.ExtendedEntities = &ExtendedEntities{Media: newMediaEntities(e.Media)}
+	}
+	return digest
+}
+
+// newDigestTweets converts tweets from the v1.1 API
+func newDigestTweets(tweets []twitter.Tweet) []DigestTweet {
+	digests := make([]DigestTweet, 0, len(tweets))
+	for i := range tweets {
+		digests = append(digests, *newDigestTweet(&tweets[i]))
+	}
+	return digests
+}
+
+func newURLEntity(u twitter.URLEntity) URLEntity {
+	return URLEntity{Indices: Indices(u.Indices), DisplayURL: u.DisplayURL, ExpandedURL: u.ExpandedURL, URL: u.URL}
+}
+
+func newMediaEntities(media []twitter.MediaEntity) []MediaEntity {
+	var entities []MediaEntity
+	for _, m := range media {
+		entity := MediaEntity{
+			URLEntity:     newURLEntity(m.URLEntity),
+			MediaURL:      m.MediaURL,
+			MediaURLHttps: m.MediaURLHttps,
+			Type:          m.Type,
+			VideoInfo:     VideoInfo{DurationMillis: m.VideoInfo.DurationMillis},
+		}
+		for _, v := range m.VideoInfo.Variants {
+			entity.VideoInfo.Variants = append(entity.VideoInfo.Variants, VideoVariant{ContentType: v.ContentType, Bitrate: v.Bitrate, URL: v.URL})
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
+
+func TestDigestTweetLoadsV1JSON(t *testing.T) {
+	// Tweets were stored as go-twitter marshalled them before DigestTweet
+	stored := []twitter.Tweet{{
+		ID:        2,
+		CreatedAt: "Tue Mar 03 14:05:00 +0000 2020",
+		FullText:  "Look https://t.co/pic",
+		User:      &twitter.User{ID: 10, Name: "Alice", ScreenName: "alice", ProfileImageURLHttps: "https://pbs.twimg.com/alice_normal.jpg"},
+		Entities: &twitter.Entities{
+			Hashtags: []twitter.HashtagEntity{{Indices: twitter.Indices{0, 4}, Text: "look"}},
+		},
+		ExtendedEntities: &twitter.ExtendedEntity{Media: []twitter.MediaEntity{{
+			URLEntity:     twitter.URLEntity{Indices: twitter.Indices{5, 21}, URL: "https://t.co/pic"},
+			MediaURLHttps: "https://pbs.twimg.com/media/pic.jpg",
+			Type:          "video",
+			VideoInfo:     twitter.VideoInfo{DurationMillis: 1500, Variants: []twitter.VideoVariant{{ContentType: "video/mp4", URL: "https://video.twimg.com/v.mp4"}}},
+		}}},
+		InReplyToStatusID: 1,
+		QuotedStatusID:    3,
+		QuotedStatus:      &twitter.Tweet{ID: 3, FullText: "quoted", User: &twitter.User{ScreenName: "bob"}},
+	}}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []DigestTweet
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	converted := newDigestTweets(stored)
+	if !reflect.DeepEqual(loaded, converted) {
+		t.Errorf("stored tweets load as\n%+v\nbut convert to\n%+v", loaded, converted)
+	}
+
+	tweet := loaded[0]
+	if tweet.User.ScreenName != "alice" || tweet.QuotedStatus.User.ScreenName != "bob" || tweet.InReplyToStatusID != 1 {
+		t.Errorf("loaded tweet is %+v", tweet)
+	}
+	media := tweet.ExtendedEntities.Media[0]
+	if media.URL != "https://t.co/pic" || media.Indices.End() != 21 || media.VideoInfo.Variants[0].URL != "https://video.twimg.com/v.mp4" {
+		t.Errorf("loaded media is %+v", media)
+	}
+}
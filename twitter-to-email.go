@@ -1,20 +1,39 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/mail"
+	neturl "net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	_ "time/tzdata" // the Lambda runtime may not ship a zoneinfo database
+	"unicode"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	"github.com/peterbourgon/ff"
@@ -23,300 +42,2951 @@ import (
 var (
 	// Configuration
 	bucket,
+	api_version,
 	consumer_api_key,
 	consumer_api_secret_key,
 	access_token,
 	access_token_secret,
-	email *string
+	bearer_token,
+	user_agent,
+	email,
+	from,
+	from_name,
+	subject_template,
+	subject_prefix,
+	template_file,
+	overflow,
+	mode,
+	slack_webhook_url,
+	image_proxy_base,
+	layout,
+	time_format,
+	locale,
+	feeds_file,
+	key_prefix,
+	last_run_key,
+	store,
+	store_dir,
+	s3_endpoint,
+	s3_sse,
+	s3_kms_key_id,
+	mailer,
+	smtp_host,
+	smtp_user,
+	smtp_pass,
+	list_unsubscribe,
+	reply_to,
+	timezone,
+	log_level,
+	metrics_namespace,
+	dry_run_file,
+	catch_up_start,
+	catch_up_end,
+	serve,
+	config_s3 *string
+	max_pages,
+	count,
+	max_tweets_per_email,
+	window_hours,
+	max_lookback_windows,
+	smtp_port,
+	twitter_retries,
+	aws_retries,
+	store_retries *int
+	list_id *int64
+	twitter_max_backoff,
+	aws_max_backoff,
+	max_age,
+	mirror_media_expiry,
+	request_timeout *time.Duration
+	exclude_retweets,
+	exclude_replies,
+	only_users_retweets,
+	collapse_duplicate_rt,
+	exclude_quoted,
+	group_threads,
+	digest_header,
+	send_empty_digest,
+	s3_force_path_style,
+	pretty_store,
+	raw_email,
+	rolling,
+	stitch_self_threads,
+	show_engagement,
+	show_reply_mentions,
+	strip_tracking_params,
+	email_compat,
+	archive_html,
+	mirror_media,
+	selftest,
+	dry_run,
+	local *bool
+	recipients,
+	cc,
+	bcc,
+	output,
+	mute_users,
+	mute_keywords,
+	only_users,
+	tracking_params stringList
+
+	// Parsed from timezone
+	location *time.Location
+	// Loaded from feeds_file, or a single feed from the other options
+	feeds []*feed
+	// Selected by store
+	tweetStore Store
+	// Where timelines are fetched from, replaced by fakes in tests
+	tweetSource TweetSource = twitterAPI{}
+	// Returns the Mailer emailing a feed, replaced by fakes in tests
+	mailerFor = newMailer
+	// Tells the time windows are computed from, pinned in tests
+	clock = time.Now
+	// Parsed from output
+	outputs map[string]bool
+	// Parsed from cc and bcc
+	ccAddresses, bccAddresses []*string
 
 	sess = session.Must(session.NewSession())
+
+	jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
 
-// formatDate formats dates into a valid S3 key
-func formatDate(date time.Time) string {
-	return fmt.Sprintf("tweets/%d-%02d-%02d-%d/tweets.json", date.Year(), date.Month(), date.Day(), date.Hour() / 8)
+// feed is one digest: a source of tweets emailed to its own recipients, with
+// its own keys in the S3 bucket
+type feed struct {
+	Name            string   `json:"name"`
+	ListID          int64    `json:"list-id"`
+	Recipients      []string `json:"recipients"`
+	SubjectTemplate string   `json:"subject-template"`
+	// Title names the feed in its emails, its name by default
+	Title string `json:"title"`
+
+	// Parsed from Recipients
+	toAddresses []*string
+}
+
+// keyPrefix returns the prefix of store keys for a feed under key_prefix, so
+// feeds don’t collide with each other
+func keyPrefix(f *feed) string {
+	if f.Name != "" {
+		return fmt.Sprintf("%s%s/", *key_prefix, f.Name)
+	}
+	if f.ListID != 0 {
+		return fmt.Sprintf("%slist-%d/", *key_prefix, f.ListID)
+	}
+	return *key_prefix
+}
+
+// resolveMode validates mode, and turns the deprecated rolling option into
+// mode realtime unless mode was set to something else
+func resolveMode(modeSet bool) error {
+	if *mode != "digest" && *mode != "realtime" {
+		return fmt.Errorf("invalid mode %q: must be digest or realtime", *mode)
+	}
+	if !*rolling {
+		return nil
+	}
+	if modeSet && *mode != "realtime" {
+		return fmt.Errorf("invalid rolling %t: conflicts with mode %q, set mode to realtime instead", *rolling, *mode)
+	}
+	slog.Warn("The rolling option is deprecated, set mode to realtime instead", "event", "deprecated_option", "option", "rolling")
+	*mode = "realtime"
+	return nil
 }
 
-// getTodaysKey returns a valid key name derived from the current date in UTC
-func getTodaysKey() string {
-	return formatDate(time.Now().UTC())
+// normalizeKeyPrefix trims the slashes around a key prefix, and ends it with a
+// single one unless it is empty
+func normalizeKeyPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
 }
 
-// getYesterdaysKey returns a valid key name derived from the previous day in UTC
-func getYesterdaysKey() string {
-	return formatDate(time.Now().UTC().Add(time.Hour * (-8)))
+// formatDate formats dates into a valid store key for a feed, with one key per
+// window of window_hours in the day
+func formatDate(f *feed, date time.Time) string {
+	return fmt.Sprintf("%s%d-%02d-%02d-%d/tweets.json", keyPrefix(f), date.Year(), date.Month(), date.Day(), date.Hour() / *window_hours)
 }
 
-// getStoredTweets retrieves stored tweets from a given key in the S3 bucket
-func getStoredTweets(key string) ([]twitter.Tweet, error) {
-	svc := s3.New(sess)
-	fmt.Printf("Getting tweets from: s3://%s/%s\n", *bucket, key)
-	result, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: bucket,
-		Key:    aws.String(key),
-	})
+// windowStart returns the start of the window n windows before the one
+// containing date. Windows are computed on the wall clock, so they stay
+// aligned across day, month, year and DST boundaries.
+func windowStart(date time.Time, n int) time.Time {
+	hour := date.Hour() / *window_hours * *window_hours
+	return time.Date(date.Year(), date.Month(), date.Day(), hour-n**window_hours, 0, 0, 0, date.Location())
+}
+
+// getTodaysKey returns a valid key name derived from the clock’s date in the
+// configured timezone. Keys name the local date and window, so changing the
+// timezone moves window boundaries: the first run afterwards may map to a key
+// that was already used, or skip one, and fall back to the previous window.
+func getTodaysKey(f *feed) string {
+	return formatDate(f, windowStart(clock().In(location), 0))
+}
+
+// window is a digest window of a feed, and the key its tweets are stored at
+type window struct {
+	key        string
+	start, end time.Time
+}
+
+// previousWindow returns the window n windows before the current one in the
+// configured timezone
+func previousWindow(f *feed, n int) window {
+	now := clock().In(location)
+	start := windowStart(now, n)
+	return window{key: formatDate(f, start), start: start, end: windowStart(now, n-1)}
+}
+
+// windowAt returns the window of a feed containing date
+func windowAt(f *feed, date time.Time) window {
+	start := windowStart(date, 0)
+	return window{key: formatDate(f, start), start: start, end: windowStart(date, -1)}
+}
+
+// twitterEpoch is when tweet IDs start, in milliseconds since the Unix epoch
+const twitterEpoch = 1288834974657
+
+// snowflakeID returns the lowest tweet ID Twitter may give a tweet posted at
+// t. Tweet IDs start with a timestamp, so tweets can be fetched by time with
+// since_id and max_id.
+func snowflakeID(t time.Time) int64 {
+	return (t.UnixNano()/int64(time.Millisecond) - twitterEpoch) << 22
+}
+
+// sinceIDKey returns where the ID of the newest tweet seen so far is stored
+func sinceIDKey(f *feed) string {
+	return keyPrefix(f) + "since_id"
+}
+
+// twitterClients caches the Twitter clients across warm Lambda invocations in
+// the same container, so that connections are reused
+var twitterClients struct {
+	sync.Mutex
+	// The credentials and timeout the clients were built with
+	key    string
+	http   *http.Client
+	client *twitter.Client
+}
+
+// twitterClient returns an http.Client authorizing requests to the Twitter
+// API with a timeout of request_timeout, and a Twitter client using it. They
+// are built on first use, and again if the credentials changed since.
+func twitterClient() (*http.Client, *twitter.Client) {
+	key := twitterClientKey()
+
+	twitterClients.Lock()
+	defer twitterClients.Unlock()
+	if twitterClients.http == nil || twitterClients.key != key {
+		httpClient := twitterHTTPClient()
+		httpClient.Timeout = *request_timeout
+		if *user_agent != "" {
+			httpClient.Transport = userAgentTransport{agent: *user_agent, base: httpClient.Transport}
+		}
+		twitterClients.key = key
+		twitterClients.http = httpClient
+		twitterClients.client = twitter.NewClient(httpClient)
+	}
+	return twitterClients.http, twitterClients.client
+}
+
+// twitterClientKey identifies the credentials, timeout and user agent Twitter
+// clients are built with
+func twitterClientKey() string {
+	return strings.Join([]string{
+		*bearer_token,
+		*consumer_api_key,
+		*consumer_api_secret_key,
+		*access_token,
+		*access_token_secret,
+		request_timeout.String(),
+		*user_agent,
+	}, "\x00")
+}
+
+// twitterHTTPClient returns an http.Client authorizing requests to the Twitter
+// API, app-only with bearer_token when it is set, or in the user context of
+// the access token otherwise
+func twitterHTTPClient() *http.Client {
+	if *bearer_token != "" {
+		return &http.Client{Transport: bearerTransport{token: *bearer_token}}
+	}
+
+	config := oauth1.NewConfig(*consumer_api_key, *consumer_api_secret_key)
+	token := oauth1.NewToken(*access_token, *access_token_secret)
+	// OAuth1 http.Client will automatically authorize Requests
+	return config.Client(oauth1.NoContext, token)
+}
+
+// bearerTransport authorizes requests with an app-only bearer token
+type bearerTransport struct {
+	token string
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// userAgentTransport sets the User-Agent of requests before passing them on
+// to base, or http.DefaultTransport if it is nil
+type userAgentTransport struct {
+	agent string
+	base  http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.agent)
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// TweetSource fetches the tweets of a feed’s timeline newer than sinceID, and
+// no newer than maxID unless it is 0
+type TweetSource interface {
+	GetTweets(ctx context.Context, f *feed, sinceID, maxID int64) ([]DigestTweet, error)
+}
+
+// twitterAPI is the TweetSource fetching from the Twitter API
+type twitterAPI struct{}
+
+func (twitterAPI) GetTweets(ctx context.Context, f *feed, sinceID, maxID int64) ([]DigestTweet, error) {
+	return getTweets(ctx, f, sinceID, maxID)
+}
+
+// getNewTweets retrieves tweets newer than sinceID from tweetSource. With the
+// Twitter API, each request is bounded by request_timeout, and ctx bounds
+// waits between retries.
+func getNewTweets(ctx context.Context, f *feed, sinceID int64) ([]DigestTweet, error) {
+	return tweetSource.GetTweets(ctx, f, sinceID, 0)
+}
+
+// getTweets retrieves tweets newer than sinceID, and no newer than maxID
+// unless it is 0
+func getTweets(ctx context.Context, f *feed, sinceID, maxID int64) ([]DigestTweet, error) {
+	httpClient, client := twitterClient()
+
+	// The home timeline, or a List timeline when one is configured
+	getPage := func(maxID int64) ([]DigestTweet, *http.Response, error) {
+		if f.ListID != 0 {
+			return getListStatuses(httpClient, f.ListID, sinceID, maxID)
+		}
+		if *api_version == "2" {
+			return getV2HomeTimeline(httpClient, sinceID, maxID)
+		}
+		tweets, resp, err := client.Timelines.HomeTimeline(&twitter.HomeTimelineParams{
+			SinceID:   sinceID,
+			MaxID:     maxID,
+			TweetMode: "extended",
+			Count:     *count,
+		})
+		return newDigestTweets(tweets), resp, err
+	}
+	return walkTimeline(ctx, sinceID, maxID, getPage)
+}
+
+// walkTimeline walks a timeline backwards a page at a time from getPage, using
+// maxID until it reaches sinceID, runs out of tweets or max_pages
+func walkTimeline(ctx context.Context, sinceID, maxID int64, getPage func(maxID int64) ([]DigestTweet, *http.Response, error)) ([]DigestTweet, error) {
+	var tweets []DigestTweet
+	seen := map[int64]bool{}
+	for page := 0; ; page++ {
+		if page >= *max_pages {
+			slog.Warn("Stopping after max-pages, older tweets may be missing", "event", "max_pages_reached", "pages", page)
+			break
+		}
+
+		var pageTweets []DigestTweet
+		err := retryTwitter(ctx, func() (*http.Response, error) {
+			var resp *http.Response
+			var err error
+			pageTweets, resp, err = getPage(maxID)
+			return resp, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pageTweets) == 0 {
+			break
+		}
+
+		lowestID := pageTweets[0].ID
+		for _, tweet := range pageTweets {
+			if tweet.ID < lowestID {
+				lowestID = tweet.ID
+			}
+			// Pages can overlap at their boundary
+			if seen[tweet.ID] {
+				continue
+			}
+			seen[tweet.ID] = true
+			tweets = append(tweets, tweet)
+		}
+
+		maxID = lowestID - 1
+		if maxID <= sinceID {
+			break
+		}
+	}
+
+	slog.Info("New tweets found", "event", "new_tweets", "count", len(tweets))
+
+	return tweets, nil
+}
+
+// maxCount is the most tweets the home and List timelines return per page
+const maxCount = 200
+
+// listStatusesURL is the endpoint for the timeline of a List
+const listStatusesURL = "https://api.twitter.com/1.1/lists/statuses.json"
+
+// getListStatuses retrieves a page of a List timeline. go-twitter’s
+// ListsStatusesParams has no tweet_mode, so the endpoint is called directly to
+// get the same extended tweets as the home timeline.
+func getListStatuses(httpClient *http.Client, listID, sinceID, maxID int64) ([]DigestTweet, *http.Response, error) {
+	params := neturl.Values{}
+	params.Set("list_id", strconv.FormatInt(listID, 10))
+	params.Set("count", strconv.Itoa(*count))
+	params.Set("tweet_mode", "extended")
+	if sinceID != 0 {
+		params.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if maxID != 0 {
+		params.Set("max_id", strconv.FormatInt(maxID, 10))
+	}
 
+	resp, err := httpClient.Get(listStatusesURL + "?" + params.Encode())
 	if err != nil {
-		return nil, err
+		return nil, resp, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiError twitter.APIError
+		if json.NewDecoder(resp.Body).Decode(&apiError) != nil || apiError.Empty() {
+			return nil, resp, fmt.Errorf("twitter: %s", resp.Status)
+		}
+		return nil, resp, apiError
 	}
 
 	var tweets []twitter.Tweet
-	err = json.NewDecoder(result.Body).Decode(&tweets)
-	return tweets, err
+	err = json.NewDecoder(resp.Body).Decode(&tweets)
+	return newDigestTweets(tweets), resp, err
+}
+
+// retryTwitter calls fn until it succeeds, fails with an error that isn’t
+// worth retrying, or runs out of attempts. Rate limited calls wait until the
+// x-rate-limit-reset time, server errors back off exponentially with jitter.
+// No single wait is longer than twitter_max_backoff, and waiting stops early
+// when ctx is done.
+func retryTwitter(ctx context.Context, fn func() (*http.Response, error)) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		resp, err := fn()
+		if err == nil || resp == nil || attempt > *twitter_retries {
+			return err
+		}
+
+		var wait time.Duration
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			wait = rateLimitWait(resp)
+		case resp.StatusCode >= 500:
+			wait = backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1))
+			backoff *= 2
+		default:
+			return err
+		}
+		if wait > *twitter_max_backoff {
+			wait = *twitter_max_backoff
+		}
+
+		slog.Warn("Twitter call failed, retrying", "event", "twitter_retry", "status", resp.StatusCode, "wait", wait.String(), "attempt", attempt, "retries", *twitter_retries)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
 }
 
-// uploadTweets uploads tweets into S3 bucket at given key
-func uploadTweets(key string, tweets []twitter.Tweet) error {
-	uploader := s3manager.NewUploader(sess)
-	buf := bytes.NewBuffer([]byte{})
-	err := json.NewEncoder(buf).Encode(tweets)
+// rateLimitWait returns how long to wait for the rate limit window reported
+// by Twitter to reset
+func rateLimitWait(resp *http.Response) time.Duration {
+	reset, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64)
 	if err != nil {
-		return err
+		return *twitter_max_backoff
 	}
+	wait := time.Until(time.Unix(reset, 0))
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
 
-	fmt.Printf("Uploading %d tweets to s3://%s/%s\n", len(tweets), *bucket, key)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: bucket,
-		Key:    aws.String(key),
-		Body:   buf,
-	})
+// retryAWS calls fn until it succeeds, fails in a way not worth retrying, or
+// runs out of aws_retries attempts, backing off exponentially with jitter up
+// to aws_max_backoff. Each attempt is bounded by request_timeout, and waiting
+// stops early when ctx is done. call names the call in logs.
+func retryAWS(ctx context.Context, call string, fn func(context.Context) error) error {
+	backoff := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, *request_timeout)
+		err := fn(attemptCtx)
+		cancel()
+		if !isRetryableAWS(err) || attempt > *aws_retries {
+			return err
+		}
 
-	if err != nil {
-		return err
+		wait := backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1))
+		backoff *= 2
+		if wait > *aws_max_backoff {
+			wait = *aws_max_backoff
+		}
+
+		slog.Warn("AWS call failed, retrying", "event", "aws_retry", "call", call, "wait", wait.String(), "attempt", attempt, "retries", *aws_retries, "error", err.Error())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
 	}
-	return nil
 }
 
-// getNewTweets retrieves tweets newer than sinceID using the Twitter API
-func getNewTweets(sinceID int64) ([]twitter.Tweet, error) {
-	config := oauth1.NewConfig(*consumer_api_key, *consumer_api_secret_key)
-	token := oauth1.NewToken(*access_token, *access_token_secret)
-	// OAuth1 http.Client will automatically authorize Requests
-	httpClient := config.Client(oauth1.NoContext, token)
+// isRetryableAWS reports whether an AWS call failed because of throttling, a
+// server error or a network error, rather than something retrying won’t fix
+// like a missing key or denied access
+func isRetryableAWS(err error) bool {
+	if _, ok := err.(awserr.Error); !ok {
+		return false
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() >= 500 && failure.StatusCode() != http.StatusNotImplemented {
+		return true
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
 
-	// Twitter client
-	client := twitter.NewClient(httpClient)
+// Result summarizes a run. It is the output of the Lambda function.
+type Result struct {
+	Bucket        string
+	NewTweetCount int
+	Emailed       bool
+	Feeds         []FeedResult
+}
+
+// FeedResult summarizes what a run did for one feed
+type FeedResult struct {
+	Name          string
+	NewTweetCount int
+	Emailed       bool
+	SinceID       int64
+	// Pending is the window waiting to be delivered again after failing
+	Pending string `json:",omitempty"`
+}
+
+// Invocation is the input of the Lambda function. Scheduled events leave it
+// empty, setting CatchUpStart backfills the windows from then on instead.
+type Invocation struct {
+	CatchUpStart string `json:"catch-up-start"`
+	CatchUpEnd   string `json:"catch-up-end"`
+}
+
+// handleInvocation runs as requested by an invocation, recording how it went
+// in the last run heartbeat
+func handleInvocation(ctx context.Context, inv Invocation) (result Result, err error) {
+	started := clock()
+	defer func() {
+		recordLastRun(ctx, started, result, err)
+	}()
 
-	// Home Timeline
-	homeTimelineParams := &twitter.HomeTimelineParams{
-		SinceID:   sinceID,
-		TweetMode: "extended",
-		Count:     200,
+	if inv.CatchUpStart == "" && inv.CatchUpEnd == "" {
+		return fetchTweets(ctx)
 	}
-	tweets, _, err := client.Timelines.HomeTimeline(homeTimelineParams)
+
+	start, end, err := parseCatchUp(inv.CatchUpStart, inv.CatchUpEnd)
 	if err != nil {
-		return nil, err
+		return Result{}, err
 	}
+	return catchUpTweets(ctx, start, end)
+}
 
-	fmt.Printf("%d New Tweets Found\n", len(tweets))
+// fetchTweets fetches new tweets of each feed
+func fetchTweets(ctx context.Context) (Result, error) {
+	fetch := fetchFeed
+	if *mode == "realtime" {
+		fetch = fetchRolling
+	}
+	return runFeeds(ctx, fetch)
+}
 
-	return tweets, nil
+// catchUpTweets backfills the windows of each feed between start and end
+func catchUpTweets(ctx context.Context, start, end time.Time) (Result, error) {
+	return runFeeds(ctx, func(ctx context.Context, f *feed, result *FeedResult) error {
+		return catchUpFeed(ctx, f, start, end, result)
+	})
 }
 
-// TODO document this
-func fetchTweets() error {
-	today := getTodaysKey()
-	storedTweets, err := getStoredTweets(today)
+// runFeeds calls fetch for each feed in turn. A feed failing doesn’t stop the
+// others, their errors are combined. Metrics about the run are published to
+// CloudWatch once it is over. Each AWS call is bounded by request_timeout, and
+// the run as a whole by ctx.
+func runFeeds(ctx context.Context, fetch func(context.Context, *feed, *FeedResult) error) (result Result, err error) {
+	defer func() {
+		publishMetrics(ctx, err)
+	}()
+
+	result.Bucket = *bucket
+	if err := truncateDryRunFile(); err != nil {
+		return result, err
+	}
+	var errs []error
+	for _, f := range feeds {
+		feedResult := FeedResult{Name: f.Name}
+		err := fetch(ctx, f, &feedResult)
+		result.Feeds = append(result.Feeds, feedResult)
+		result.NewTweetCount += feedResult.NewTweetCount
+		result.Emailed = result.Emailed || feedResult.Emailed
+		if err != nil {
+			slog.Error("Feed failed", "event", "feed_failed", "feed", f.Name, "error", err.Error())
+			if f.Name != "" {
+				err = fmt.Errorf("feed %s: %w", f.Name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return result, errors.Join(errs...)
+}
 
-	var sinceID int64
+// fetchFeed adds new tweets from a feed’s timeline to the current window’s key
+// in the S3 bucket. The first run in a new window emails the tweets stored for
+// the previous one. What it did is recorded in result, even if it fails.
+//
+// Failing to deliver a window doesn’t hold up storing new tweets. The window
+// is recorded as pending and retried by the following runs until it is
+// delivered, while the run goes on and returns the delivery error along with
+// any later one. A window is only marked emailed once it was delivered, and
+// since_id only moves on once new tweets were stored, so tweets may be
+// delivered twice but aren’t lost.
+func fetchFeed(ctx context.Context, f *feed, result *FeedResult) error {
+	sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(f))
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				fmt.Printf("%s not found. Trying to retrieve yesterday’s tweets\n", today)
-				yesterday := getYesterdaysKey()
-				storedTweets, err := getStoredTweets(yesterday)
-				if err != nil {
-					if aerr, ok := err.(awserr.Error); ok {
-						switch aerr.Code() {
-						case s3.ErrCodeNoSuchKey:
-							fmt.Printf("%s not found.\n", yesterday)
-						default:
-							return aerr
-						}
-					} else {
-						return err
-					}
-				}
+		return err
+	}
 
-				if len(storedTweets) > 0 {
-					fmt.Println("Emailing yesterday’s tweets")
-					err = emailTweets(storedTweets)
-					if err != nil {
-						return err
-					}
+	var errs []error
+	fail := func(err error) error {
+		if len(errs) == 0 {
+			return err
+		}
+		return errors.Join(append(errs, err)...)
+	}
+	if err := retryPending(ctx, f, result); err != nil {
+		slog.Error("Retrying a pending window failed", "event", "retry_pending_failed", "feed", f.Name, "window", result.Pending, "error", err.Error())
+		errs = append(errs, err)
+	}
 
-					// Find last tweet from yesterday
-					lastTweet := storedTweets[0]
-					for _, tweet := range storedTweets {
-						if tweet.ID > lastTweet.ID {
-							lastTweet = tweet
-						}
-					}
+	today := getTodaysKey(f)
+	storedTweets, err := tweetStore.Get(ctx, today)
 
-					sinceID = lastTweet.ID
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			slog.Info("Current window not found, trying to retrieve previous tweets", "event", "new_window", "key", today)
+			previous, previousTweets, err := getPreviousTweets(ctx, f)
+			if err != nil {
+				return fail(err)
+			}
 
-					storedTweets = []twitter.Tweet{lastTweet}
-					fmt.Println("Uploading last tweet from yesterday for tracking")
-				} else {
-					fmt.Printf("Uploading an empty array to %s\n", today)
+			// An empty window still gets an email saying so with send_empty_digest
+			if len(previousTweets) > 0 || *send_empty_digest && previous.key != "" {
+				err = deliverWindow(ctx, f, previous, previousTweets, result)
+				if err != nil {
+					slog.Error("Delivering the previous window failed, keeping it pending", "event", "deliver_failed", "feed", f.Name, "key", previous.key, "error", err.Error())
+					errs = append(errs, fmt.Errorf("delivering %s: %w", previous.key, err))
+					if err := markPending(ctx, f, previous, result); err != nil {
+						return fail(err)
+					}
 				}
 
-				err = uploadTweets(today, storedTweets)
-				if err != nil {
-					return err
+				if sinceID == 0 {
+					// Stored before since_id was tracked on its own
+					sinceID = newestTweetID(previousTweets)
 				}
-			default:
-				return aerr
+			}
+
+			slog.Debug("Storing an empty array", "event", "start_window", "key", today)
+			err = tweetStore.Merge(ctx, today, nil)
+			if err != nil {
+				return fail(err)
 			}
 		} else {
-			return aerr
+			return fail(err)
 		}
 	} else {
-		fmt.Printf("%d Older Tweets Found\n", len(storedTweets))
+		slog.Info("Older tweets found", "event", "stored_tweets", "key", today, "count", len(storedTweets))
+
+		if sinceID == 0 {
+			// Stored before since_id was tracked on its own
+			sinceID = newestTweetID(storedTweets)
+		}
+	}
+
+	result.SinceID = sinceID
+
+	slog.Info("Getting new tweets", "event", "get_new_tweets", "since_id", sinceID)
+	newTweets, err := getNewTweets(ctx, f, sinceID)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	recordMetric("NewTweets", float64(len(newTweets)), cloudwatch.StandardUnitCount)
+	result.NewTweetCount = len(newTweets)
+
+	if len(newTweets) == 0 {
+		// Nothing more to do
+		return errors.Join(errs...)
+	}
+
+	// Track the newest tweet before any are filtered out
+	newestID := newestTweetID(newTweets)
+	newTweets = filterTweets(newTweets)
+	mirrorMedia(ctx, newTweets)
+
+	if len(newTweets) > 0 {
+		err = tweetStore.Merge(ctx, today, newTweets)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	err = tweetStore.PutTweetID(ctx, sinceIDKey(f), newestID)
+	if err != nil {
+		return fail(err)
+	}
+	result.SinceID = newestID
+	return errors.Join(errs...)
+}
+
+// deliverWindow delivers the tweets stored for a window that is over, unless
+// it was already emailed, then marks it emailed
+func deliverWindow(ctx context.Context, f *feed, w window, stored []DigestTweet, result *FeedResult) error {
+	emailedID, err := tweetStore.GetTweetID(ctx, emailedKey(w.key))
+	if err != nil {
+		return err
+	}
+	if emailedID != 0 {
+		slog.Info("Previous tweets were already emailed", "event", "already_emailed", "key", w.key)
+		return nil
+	}
+
+	// Stale tweets still count as emailed and towards since_id
+	newestID := newestTweetID(stored)
+	tweets := dropStaleTweets(w, stored)
+	if len(tweets) > 0 {
+		slog.Info("Emailing previous tweets", "event", "email_previous", "key", w.key, "count", len(tweets))
+		err = deliverTweets(ctx, f, w, tweets)
+		if err != nil {
+			return err
+		}
+		result.Emailed = true
+	} else if *send_empty_digest {
+		err = emailEmptyDigestOnce(ctx, f, w)
+		if err != nil {
+			return err
+		}
+	}
+	if newestID == 0 {
+		// No tweet was emailed
+		return nil
+	}
+	return tweetStore.PutTweetID(ctx, emailedKey(w.key), newestID)
+}
+
+// pendingKey returns where the start of the oldest window of a feed that
+// failed to be delivered is stored, in seconds since the Unix epoch
+func pendingKey(f *feed) string {
+	return keyPrefix(f) + "pending"
+}
+
+// markPending records that a window failed to be delivered, unless an older
+// one is already pending
+func markPending(ctx context.Context, f *feed, w window, result *FeedResult) error {
+	pending, err := tweetStore.GetTweetID(ctx, pendingKey(f))
+	if err != nil {
+		return err
+	}
+	if pending == 0 || w.start.Unix() < pending {
+		err = tweetStore.PutTweetID(ctx, pendingKey(f), w.start.Unix())
+		if err != nil {
+			return err
+		}
+		result.Pending = w.key
+	}
+	return nil
+}
+
+// retryPending delivers the windows of a feed that are over and weren’t
+// emailed yet, oldest first, from the pending one on. It stops at the first
+// that fails again, which is then the pending one.
+func retryPending(ctx context.Context, f *feed, result *FeedResult) error {
+	pending, err := tweetStore.GetTweetID(ctx, pendingKey(f))
+	if err != nil || pending == 0 {
+		return err
+	}
 
-		for _, tweet := range storedTweets {
-			if tweet.ID > sinceID {
-				sinceID = tweet.ID
+	current := windowAt(f, clock().In(location))
+	for w := windowAt(f, time.Unix(pending, 0).In(location)); w.start.Before(current.start); w = windowAt(f, w.end) {
+		tweets, err := tweetStore.Get(ctx, w.key)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err == nil {
+			slog.Info("Retrying a pending window", "event", "retry_pending", "key", w.key)
+			err = deliverWindow(ctx, f, w, tweets, result)
+		}
+		if err != nil {
+			result.Pending = w.key
+			if w.start.Unix() != pending {
+				if err := tweetStore.PutTweetID(ctx, pendingKey(f), w.start.Unix()); err != nil {
+					return err
+				}
 			}
+			return fmt.Errorf("delivering %s: %w", w.key, err)
 		}
 	}
+	return tweetStore.Delete(ctx, pendingKey(f))
+}
+
+// fetchRolling delivers the tweets from a feed’s timeline that are newer than
+// the last ones delivered, whatever window it is. The since_id is only moved
+// on once they were delivered, so it doubles as the delivery watermark.
+//
+// New tweets are stored at unsentKey before they are sent, so tweets a failed
+// run fetched are delivered by the next one even if Twitter stopped serving
+// them. They are cleared once since_id moved past them: a run stopping in
+// between leaves tweets no newer than since_id there, which were delivered
+// and are dropped.
+func fetchRolling(ctx context.Context, f *feed, result *FeedResult) error {
+	sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(f))
+	if err != nil {
+		return err
+	}
+	result.SinceID = sinceID
 
-    fmt.Printf("Getting new tweets since %d\n", sinceID)
-	newTweets, err := getNewTweets(sinceID)
+	unsent, err := tweetStore.Get(ctx, unsentKey(f))
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	unsent, _ = dropTweets(unsent, func(tweet *DigestTweet) bool {
+		return tweet.ID <= sinceID
+	})
 
+	slog.Info("Getting new tweets", "event", "get_new_tweets", "since_id", sinceID)
+	newTweets, err := getNewTweets(ctx, f, sinceID)
 	if err != nil {
 		return err
 	}
 
-	if len(newTweets) == 0 {
+	recordMetric("NewTweets", float64(len(newTweets)), cloudwatch.StandardUnitCount)
+	result.NewTweetCount = len(newTweets)
+
+	// The digest covers everything up to now rather than a window
+	w := window{key: getTodaysKey(f), end: clock().In(location)}
+	if len(newTweets) == 0 && len(unsent) == 0 {
+		if *send_empty_digest {
+			return emailEmptyDigestOnce(ctx, f, w)
+		}
 		// Nothing more to do
 		return nil
 	}
 
-	tweets := append(newTweets, storedTweets...)
+	newestID := newestTweetID(append(newTweets, unsent...))
+	newTweets = filterTweets(newTweets)
+	mirrorMedia(ctx, newTweets)
+
+	if len(newTweets) > 0 {
+		err = tweetStore.Merge(ctx, unsentKey(f), newTweets)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tweets := mergeTweets(newTweets, unsent); len(tweets) > 0 {
+		slog.Info("Delivering new tweets", "event", "deliver_rolling", "count", len(tweets), "unsent", len(unsent))
+		err = deliverTweets(ctx, f, w, tweets)
+		if err != nil {
+			return err
+		}
+		result.Emailed = true
+	} else if *send_empty_digest {
+		err = emailEmptyDigestOnce(ctx, f, w)
+		if err != nil {
+			return err
+		}
+	}
 
-	return uploadTweets(today, tweets)
+	err = tweetStore.PutTweetID(ctx, sinceIDKey(f), newestID)
+	if err != nil {
+		return err
+	}
+	result.SinceID = newestID
+	return tweetStore.Delete(ctx, unsentKey(f))
 }
 
-// emailTweets formats and emails tweets
-func emailTweets(tweets []twitter.Tweet) error {
-	builder := strings.Builder{}
+// unsentKey returns where rolling digests keep the tweets of a feed until they
+// were delivered
+func unsentKey(f *feed) string {
+	return keyPrefix(f) + "unsent.json"
+}
 
-	for i := len(tweets) - 2; i > -1; i-- {
-		tweet := tweets[i]
-		builder.WriteString(buildTweet(&tweet))
-	}
-
-	svc := ses.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")}, // SES is only available in limited AWS regions, so we hardcode the region here.
-	)))
-
-	// Assemble the email.
-	input := &ses.SendEmailInput{
-		Destination: &ses.Destination{
-			CcAddresses: []*string{},
-			ToAddresses: []*string{
-				email,
-			},
-		},
-		Message: &ses.Message{
-			Body: &ses.Body{
-				Html: &ses.Content{
-					Charset: aws.String("UTF-8"),
-					Data:    aws.String(builder.String()),
-				},
-			},
-			Subject: &ses.Content{
-				Charset: aws.String("UTF-8"),
-				Data:    aws.String("Tweets from the past 8h"),
-			},
-		},
-		Source: email,
-	}
-
-	// Attempt to send the email.
-	_, err := svc.SendEmail(input)
-	return err
-}
-
-
-func buildTweet(tweet *twitter.Tweet) string {
-	builder := strings.Builder{}
-    builder.WriteString(`
-<div style="margin-bottom: 10px; font: 15px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">
-    `)
-    if tweet.RetweetedStatus != nil {
-        html := `
-  <div style="display: flex;">
-    <svg viewBox="0 0 24 24" style="color: rgb(45, 51, 55); fill: currentcolor; width: 13px;">
-      <g>
-        <path d="M23.615 15.477c-.47-.47-1.23-.47-1.697 0l-1.326 1.326V7.4c0-2.178-1.772-3.95-3.95-3.95h-5.2c-.663 0-1.2.538-1.2 1.2s.537 1.2 1.2 1.2h5.2c.854 0 1.55.695 1.55 1.55v9.403l-1.326-1.326c-.47-.47-1.23-.47-1.697 0s-.47 1.23 0 1.697l3.374 3.375c.234.233.542.35.85.35s.613-.116.848-.35l3.375-3.376c.467-.47.467-1.23-.002-1.697zM12.562 18.5h-5.2c-.854 0-1.55-.695-1.55-1.55V7.547l1.326 1.326c.234.235.542.352.848.352s.614-.117.85-.352c.468-.47.468-1.23 0-1.697L5.46 3.8c-.47-.468-1.23-.468-1.697 0L.388 7.177c-.47.47-.47 1.23 0 1.697s1.23.47 1.697 0L3.41 7.547v9.403c0 2.178 1.773 3.95 3.95 3.95h5.2c.664 0 1.2-.538 1.2-1.2s-.535-1.2-1.198-1.2z"></path>
-      </g>
-    </svg>
-    <a href="%s" style="color: rgb(136, 153, 166); font-size: 14px; margin-left: 105px; text-decoration: none;">%s Retweeted</a>
-  </div>
-        `
-        retweeter_url := fmt.Sprintf("https://twitter.com/%s", tweet.User.ScreenName)
-        builder.WriteString(fmt.Sprintf(
-            html,
-            retweeter_url,
-            tweet.User.Name,
-        ))
-        tweet = tweet.RetweetedStatus
-    }
-    html := `
-  <div style="display: flex;">
-    <a href="%s" style="border-radius: 9999px; flex-shrink: 0; margin-right: 5px; max-height: 100px; min-width: 100px; overflow: hidden;">
-      <img src="%s" style="height: 100px; width: 100px;">
-    </a>
-    <div>
-      <div>
-        <a href="%s" style="color: rgb(45, 51, 55); text-decoration: none;">
-          <span style="font-weight: bold;">%s</span>
-          <span style="color: rgb(136, 153, 166);">@%s</span>
-        </a>
-      </div>
-      <div style="line-height: 1.3125; width: 50%%;">
-        <a href="%s" style="color: black; text-decoration: none;">%s</a>
-      </div>
-    </div>
-  </div>
-</div>
-    `
-    tweeter_url := fmt.Sprintf("https://twitter.com/%s", tweet.User.ScreenName)
-    tweeter_image := strings.Replace(tweet.User.ProfileImageURLHttps, "_normal.", "_reasonably_small.", 1)
-    tweet_url := fmt.Sprintf("https://twitter.com/%s/status/%d", tweet.User.ScreenName, tweet.ID)
-    builder.WriteString(fmt.Sprintf(
-        html,
-        tweeter_url,
-        tweeter_image,
-        tweeter_url,
-        tweet.User.Name,
-        tweet.User.ScreenName,
-        tweet_url,
-        tweet.FullText))
+// catchUpFeed backfills the windows of a feed from the one containing start
+// up to end. The tweets of each window are fetched between the tweet IDs of
+// its bounds and merged into its key, then delivered like by a regular run if
+// the window is over. A window failing doesn’t stop the others, their errors
+// are combined, and those that couldn’t be delivered are left pending. The
+// since_id is left alone. Twitter only serves the most recent tweets of a
+// timeline, so windows too far back may stay empty.
+func catchUpFeed(ctx context.Context, f *feed, start, end time.Time, result *FeedResult) error {
+	now := clock()
+	var errs []error
+	for date := start.In(location); date.Before(end); {
+		w := windowAt(f, date)
+		date = w.end
 
-	return builder.String()
+		slog.Info("Catching up on window", "event", "catch_up_window", "key", w.key)
+		err := catchUpWindow(ctx, f, w, result)
+		if err == nil && !w.end.After(now) {
+			err = redeliverWindow(ctx, f, w, result)
+		}
+		if err != nil {
+			slog.Error("Catching up on window failed", "event", "catch_up_failed", "feed", f.Name, "key", w.key, "error", err.Error())
+			errs = append(errs, fmt.Errorf("catching up on %s: %w", w.key, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-// getConfig populates the config variables from a JSON file
-func getConfig() {
-	fs := flag.NewFlagSet("twitter-to-email", flag.ExitOnError)
+// catchUpWindow fetches the tweets posted during a window and merges them
+// into its key
+func catchUpWindow(ctx context.Context, f *feed, w window, result *FeedResult) error {
+	newTweets, err := tweetSource.GetTweets(ctx, f, snowflakeID(w.start)-1, snowflakeID(w.end)-1)
+	if err != nil {
+		return err
+	}
 
-	bucket = fs.String("bucket", "", "S3 Bucket")
-	consumer_api_key = fs.String("consumer-api-key", "", "Twitter Consumer API Key")
-	consumer_api_secret_key = fs.String("consumer-api-secret-key", "", "Twitter Consumer API Secret Key")
-	access_token = fs.String("access-token", "", "Twitter Access token")
-	access_token_secret = fs.String("access-token-secret", "", "Twitter Access token secret")
-	email = fs.String("email", "", "Email")
+	recordMetric("NewTweets", float64(len(newTweets)), cloudwatch.StandardUnitCount)
+	result.NewTweetCount += len(newTweets)
 
-	ff.Parse(fs, []string{},
-		ff.WithConfigFile("config.json"),
-		ff.WithConfigFileParser(ff.JSONParser))
+	newTweets = filterTweets(newTweets)
+	mirrorMedia(ctx, newTweets)
+	if len(newTweets) == 0 {
+		return nil
+	}
+	return tweetStore.Merge(ctx, w.key, newTweets)
 }
 
-func main() {
-	getConfig()
-	lambda.Start(fetchTweets)
+// redeliverWindow delivers the tweets stored for a window that is over unless
+// it was already, leaving it pending if that fails
+func redeliverWindow(ctx context.Context, f *feed, w window, result *FeedResult) error {
+	tweets, err := tweetStore.Get(ctx, w.key)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = deliverWindow(ctx, f, w, tweets, result)
+	if err != nil {
+		return errors.Join(fmt.Errorf("delivering: %w", err), markPending(ctx, f, w, result))
+	}
+	return nil
+}
+
+// filterTweets drops the retweets, replies and muted tweets the options leave
+// out of the digest
+func filterTweets(tweets []DigestTweet) []DigestTweet {
+	if *exclude_retweets {
+		var dropped int
+		tweets, dropped = dropTweets(tweets, isRetweet)
+		slog.Info("Dropped retweets", "event", "drop_retweets", "count", dropped)
+	}
+
+	if *exclude_replies {
+		var dropped int
+		tweets, dropped = dropTweets(tweets, isReply)
+		slog.Info("Dropped replies", "event", "drop_replies", "count", dropped)
+	}
+
+	if len(only_users) > 0 {
+		var dropped int
+		tweets, dropped = dropTweets(tweets, func(tweet *DigestTweet) bool {
+			return !isAllowed(tweet)
+		})
+		slog.Info("Dropped tweets by other users", "event", "drop_not_allowed", "count", dropped)
+	}
+
+	if len(mute_users) > 0 || len(mute_keywords) > 0 {
+		var dropped int
+		tweets, dropped = dropTweets(tweets, isMuted)
+		slog.Info("Dropped muted tweets", "event", "drop_muted", "count", dropped)
+	}
+
+	return tweets
+}
+
+// getPreviousTweets retrieves the tweets stored for the most recent window
+// before the current one, and that window. Runs may have been skipped, so it
+// walks back through up to max_lookback_windows windows until it finds one
+// that was stored.
+func getPreviousTweets(ctx context.Context, f *feed) (window, []DigestTweet, error) {
+	for n := 1; n <= *max_lookback_windows; n++ {
+		w := previousWindow(f, n)
+		tweets, err := tweetStore.Get(ctx, w.key)
+		if err == nil {
+			return w, tweets, nil
+		}
+		if !errors.Is(err, errNotFound) {
+			return window{}, nil, err
+		}
+		slog.Debug("Window not found", "event", "window_not_found", "key", w.key)
+	}
+	return window{}, nil, nil
+}
+
+// emailedKey returns where the newest tweet emailed from the window stored at
+// key is recorded, so that a retried run doesn’t email the window again
+func emailedKey(key string) string {
+	return strings.TrimSuffix(key, "tweets.json") + "emailed"
+}
+
+// emptyEmailedKey returns where the time the empty digest of the window stored
+// at key was sent is recorded, in seconds since the Unix epoch, so that it is
+// only sent once
+func emptyEmailedKey(key string) string {
+	return strings.TrimSuffix(key, "tweets.json") + "empty-emailed"
+}
+
+// newestTweetID returns the highest ID among tweets
+func newestTweetID(tweets []DigestTweet) int64 {
+	var id int64
+	for _, tweet := range tweets {
+		if tweet.ID > id {
+			id = tweet.ID
+		}
+	}
+	return id
+}
+
+// dropStaleTweets returns the tweets stored for a window without the ones
+// posted more than max_age before it started, which don’t belong in its
+// digest. Tweets with an unknown posting time are kept.
+func dropStaleTweets(w window, tweets []DigestTweet) []DigestTweet {
+	if *max_age <= 0 {
+		return tweets
+	}
+	cutoff := w.start.Add(-*max_age)
+	tweets, dropped := dropTweets(append([]DigestTweet{}, tweets...), func(tweet *DigestTweet) bool {
+		createdAt, err := tweet.CreatedAtTime()
+		return err == nil && createdAt.Before(cutoff)
+	})
+	if dropped > 0 {
+		slog.Warn("Dropped stale tweets", "event", "drop_stale", "key", w.key, "count", dropped)
+	}
+	return tweets
+}
+
+// dropTweets returns tweets without the ones matching drop, and how many were
+// dropped
+func dropTweets(tweets []DigestTweet, drop func(*DigestTweet) bool) ([]DigestTweet, int) {
+	kept := tweets[:0]
+	for _, tweet := range tweets {
+		if !drop(&tweet) {
+			kept = append(kept, tweet)
+		}
+	}
+	return kept, len(tweets) - len(kept)
+}
+
+// dedupTweets drops tweets whose ID appeared earlier in tweets. New tweets
+// come first, so the newest copy of a tweet fetched twice is kept. Of the
+// versions of an edited tweet, only the latest edit is kept.
+func dedupTweets(tweets []DigestTweet) []DigestTweet {
+	latest := make(map[int64]int64, len(tweets))
+	for _, tweet := range tweets {
+		if initial := tweet.InitialID(); tweet.ID > latest[initial] {
+			latest[initial] = tweet.ID
+		}
+	}
+
+	seen := make(map[int64]bool, len(tweets))
+	deduped, dropped := dropTweets(tweets, func(tweet *DigestTweet) bool {
+		if seen[tweet.ID] || latest[tweet.InitialID()] != tweet.ID {
+			return true
+		}
+		seen[tweet.ID] = true
+		return false
+	})
+	if dropped > 0 {
+		slog.Info("Dropped duplicate tweets", "event", "drop_duplicates", "count", dropped)
+	}
+	return deduped
+}
+
+// collapseRetweets keeps only the earliest of several retweets of the same
+// tweet, crediting everyone who retweeted it in its byline
+func collapseRetweets(tweets []DigestTweet) []DigestTweet {
+	retweets := map[int64][]DigestTweet{}
+	// Retweets without a retweeter have no one to credit, and are left alone
+	collapsible := func(tweet DigestTweet) bool {
+		return tweet.RetweetedStatus != nil && tweet.User != nil
+	}
+	for _, tweet := range tweets {
+		if collapsible(tweet) {
+			retweets[tweet.RetweetedStatus.ID] = append(retweets[tweet.RetweetedStatus.ID], tweet)
+		}
+	}
+
+	var collapsed []DigestTweet
+	for _, tweet := range tweets {
+		if !collapsible(tweet) || len(retweets[tweet.RetweetedStatus.ID]) == 1 {
+			collapsed = append(collapsed, tweet)
+			continue
+		}
+
+		group := retweets[tweet.RetweetedStatus.ID]
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].ID < group[j].ID
+		})
+		if tweet.ID != group[0].ID {
+			continue
+		}
+		var names []string
+		for _, retweet := range group {
+			names = append(names, retweet.User.Name)
+		}
+		// Copied, as the user may be shared with other tweets
+		user := *tweet.User
+		user.Name = joinNames(names)
+		tweet.User = &user
+		collapsed = append(collapsed, tweet)
+	}
+
+	if dropped := len(tweets) - len(collapsed); dropped > 0 {
+		slog.Info("Collapsed duplicate retweets", "event", "collapse_retweets", "count", dropped)
+	}
+	return collapsed
+}
+
+// dropQuotedTweets leaves out tweets, sorted oldest first, that another tweet
+// among them quotes, as they are already shown nested in it. Tweets quoting
+// come after the ones they quote, and only the ones kept count.
+func dropQuotedTweets(tweets []DigestTweet) []DigestTweet {
+	quoted := map[int64]bool{}
+	kept := make([]DigestTweet, len(tweets))
+	n := len(kept)
+	for i := len(tweets) - 1; i >= 0; i-- {
+		tweet := &tweets[i]
+		shown := tweet
+		if tweet.RetweetedStatus != nil {
+			shown = tweet.RetweetedStatus
+		}
+		if quoted[shown.ID] {
+			continue
+		}
+		// Unavailable quoted tweets are only a placeholder
+		if shown.QuotedStatus != nil && shown.QuotedStatus.User != nil {
+			quoted[shown.QuotedStatusID] = true
+		}
+		n--
+		kept[n] = *tweet
+	}
+
+	if n > 0 {
+		slog.Info("Dropped quoted tweets", "event", "drop_quoted", "count", n)
+	}
+	return kept[n:]
+}
+
+// joinNames lists names in prose, like "A, B, and C"
+func joinNames(names []string) string {
+	switch len(names) {
+	case 1:
+		return names[0]
+	case 2:
+		return names[0] + " and " + names[1]
+	default:
+		return strings.Join(names[:len(names)-1], ", ") + ", and " + names[len(names)-1]
+	}
+}
+
+// isRetweet reports whether tweet is a retweet
+func isRetweet(tweet *DigestTweet) bool {
+	return tweet.RetweetedStatus != nil
+}
+
+// isMuted reports whether tweet, or the tweet it retweets, is by a muted user
+// or contains a muted keyword
+func isMuted(tweet *DigestTweet) bool {
+	authors := []*TweetUser{tweet.User}
+	if tweet.RetweetedStatus != nil {
+		tweet = tweet.RetweetedStatus
+		authors = append(authors, tweet.User)
+	}
+
+	for _, author := range authors {
+		if isListed(mute_users, author) {
+			return true
+		}
+	}
+
+	if tweet.RetweetedStatus != nil {
+		// The retweet’s own text may be truncated
+		tweet = tweet.RetweetedStatus
+	}
+	text := strings.ToLower(fullText(tweet))
+	for _, keyword := range mute_keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowed reports whether tweet, or the tweet it retweets, is by one of
+// only_users, or whether it was retweeted by one of them when
+// only_users_retweets is set
+func isAllowed(tweet *DigestTweet) bool {
+	if tweet.RetweetedStatus == nil {
+		return isListed(only_users, tweet.User)
+	}
+	return isListed(only_users, tweet.RetweetedStatus.User) || *only_users_retweets && isListed(only_users, tweet.User)
+}
+
+// isListed reports whether user is among screen names, which may start with @
+func isListed(screenNames []string, user *TweetUser) bool {
+	if user == nil {
+		return false
+	}
+	for _, name := range screenNames {
+		if strings.EqualFold(strings.TrimPrefix(name, "@"), user.ScreenName) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReply reports whether tweet is a reply to another tweet or user
+func isReply(tweet *DigestTweet) bool {
+	return tweet.InReplyToStatusID != 0 || tweet.InReplyToUserID != 0 || tweet.InReplyToScreenName != ""
+}
+
+// deliverTweets emails the tweets stored for a window, publishes them to the
+// feed’s Atom feed or as Markdown, or posts them to Slack, as set by output.
+// Once they were emailed, the other outputs failing is only logged, so that
+// the window isn’t emailed again. Posting to Slack failing always is, so that
+// the run still moves on to the next window.
+func deliverTweets(ctx context.Context, f *feed, w window, tweets []DigestTweet) error {
+	emailed := false
+	if outputs["email"] {
+		err := emailTweets(ctx, f, w, tweets)
+		if err != nil {
+			return err
+		}
+		emailed = true
+	}
+	published := func(err error, event, metric string) error {
+		if err == nil || !emailed {
+			return err
+		}
+		slog.Error("Publishing the digest failed", "event", event, "feed", f.Name, "error", err.Error())
+		recordMetric(metric, 1, cloudwatch.StandardUnitCount)
+		return nil
+	}
+	if outputs["rss"] {
+		err := published(publishAtom(ctx, f, tweets), "atom_failed", "AtomFailures")
+		if err != nil {
+			return err
+		}
+	}
+	if outputs["markdown"] {
+		err := published(publishMarkdown(ctx, f, w, tweets), "markdown_failed", "MarkdownFailures")
+		if err != nil {
+			return err
+		}
+	}
+	if outputs["slack"] {
+		err := postSlack(ctx, tweets)
+		if err != nil {
+			slog.Error("Posting to Slack failed", "event", "slack_failed", "feed", f.Name, "error", err.Error())
+			recordMetric("SlackFailures", 1, cloudwatch.StandardUnitCount)
+		}
+	}
+	return nil
+}
+
+// emailTweets formats the tweets stored for a window and emails them to the
+// recipients of a feed with the configured mailer, archiving the ones sent.
+// A part failing to send doesn’t stop the others, their errors are combined.
+func emailTweets(ctx context.Context, f *feed, w window, tweets []DigestTweet) error {
+	if len(tweets) == 0 {
+		slog.Info("No tweets to email", "event", "no_tweets")
+		return nil
+	}
+	emails, err := buildEmails(f, w, tweets)
+	if err != nil {
+		return err
+	}
+	// Presigned URLs of mirrored media expire, so the archive doesn’t use them
+	archived := emails
+	if *archive_html && *mirror_media {
+		archived, err = buildEmails(f, w, permanentMedia(tweets))
+		if err != nil {
+			return err
+		}
+	}
+
+	m, err := mailerFor(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, e := range emails {
+		err = m.Send(e.subject, e.htmlBody, e.textBody)
+		if err != nil {
+			slog.Error("Sending email failed", "event", "send_failed", "part", i+1, "parts", len(emails), "error", err.Error())
+			if len(emails) > 1 {
+				err = fmt.Errorf("part %d/%d: %w", i+1, len(emails), err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		if !*dry_run {
+			recordMetric("EmailedTweets", float64(e.tweets), cloudwatch.StandardUnitCount)
+		}
+		archiveEmail(ctx, f, w, i+1, len(emails), archived[i])
+	}
+	return errors.Join(errs...)
+}
+
+// emailEmptyDigest emails the recipients of a feed that there are no tweets
+// for a window, for send_empty_digest
+func emailEmptyDigest(ctx context.Context, f *feed, w window) error {
+	if !outputs["email"] {
+		return nil
+	}
+	slog.Info("Emailing that there are no tweets", "event", "email_empty", "key", w.key)
+	m, err := mailerFor(ctx, f)
+	if err != nil {
+		return err
+	}
+	e := buildEmptyEmail(f, w)
+	return m.Send(e.subject, e.htmlBody, e.textBody)
+}
+
+// emailEmptyDigestOnce emails the empty digest of a window unless it was
+// already sent, then records that it was. Rolling digests share the key of the
+// window they are sent in, so they send at most one per window.
+func emailEmptyDigestOnce(ctx context.Context, f *feed, w window) error {
+	sent, err := tweetStore.GetTweetID(ctx, emptyEmailedKey(w.key))
+	if err != nil {
+		return err
+	}
+	if sent != 0 {
+		slog.Info("The empty digest was already emailed", "event", "already_emailed_empty", "key", w.key)
+		return nil
+	}
+	err = emailEmptyDigest(ctx, f, w)
+	if err != nil {
+		return err
+	}
+	return tweetStore.PutTweetID(ctx, emptyEmailedKey(w.key), clock().Unix())
+}
+
+// buildEmptyEmail renders the email saying there are no tweets for a window.
+// Rolling digests have no start, only when they were sent.
+func buildEmptyEmail(f *feed, w window) digestEmail {
+	span := w.end.Format(msgs.DateLayout)
+	if !w.start.IsZero() {
+		end := w.end.Format(msgs.DateLayout)
+		if w.start.YearDay() == w.end.YearDay() && w.start.Year() == w.end.Year() {
+			end = w.end.Format(msgs.TimeLayout)
+		}
+		span = w.start.Format(msgs.DateLayout) + "–" + end
+	}
+
+	subject := fmt.Sprintf(msgs.NoTweetsSubject, span)
+	if f.Name != "" {
+		subject = "[" + f.Title + "] " + subject
+	}
+	if *subject_prefix != "" {
+		subject = "[" + *subject_prefix + "] " + subject
+	}
+
+	text := fmt.Sprintf(msgs.NoTweets, span)
+	body := `
+<div style="color: rgb(136, 153, 166); margin-bottom: 10px; font: 14px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">%s</div>`
+	htmlBody, textBody := fmt.Sprintf(body, html.EscapeString(text)), text+"\n"
+	if f.Name != "" {
+		htmlHeader, textHeader := buildFeedHeader(digestData{Feed: f.Title})
+		htmlBody = htmlHeader + htmlBody
+		textBody = textHeader + textBody
+	}
+	if *email_compat {
+		htmlBody = compatFonts.Replace(htmlBody)
+	}
+	return digestEmail{subject: subject, htmlBody: htmlBody, textBody: textBody}
+}
+
+// digestEmail is one email of a digest, and how many tweets it holds
+type digestEmail struct {
+	subject, htmlBody, textBody string
+	tweets                      int
+}
+
+// buildEmails renders the emails of the digest of a window. Beyond
+// max_tweets_per_email tweets, the digest is split into several emails or
+// truncated.
+func buildEmails(f *feed, w window, tweets []DigestTweet) ([]digestEmail, error) {
+	tweets = dedupTweets(tweets)
+	if *collapse_duplicate_rt {
+		tweets = collapseRetweets(tweets)
+	}
+	tweets = sortTweets(tweets)
+	if *exclude_quoted {
+		tweets = dropQuotedTweets(tweets)
+	}
+
+	parts := [][]DigestTweet{tweets}
+	var more int
+	if limit := *max_tweets_per_email; limit > 0 && len(tweets) > limit {
+		if *overflow == "truncate" {
+			more = len(tweets) - limit
+			parts = [][]DigestTweet{tweets[:limit]}
+		} else {
+			parts = nil
+			for start := 0; start < len(tweets); start += limit {
+				end := start + limit
+				if end > len(tweets) {
+					end = len(tweets)
+				}
+				parts = append(parts, tweets[start:end])
+			}
+		}
+		slog.Info("Digest is over max-tweets-per-email", "event", "digest_overflow", "count", len(tweets), "overflow", *overflow, "parts", len(parts))
+	}
+
+	var emails []digestEmail
+	for i, part := range parts {
+		htmlBody, textBody := buildDigest(part)
+
+		data := digestSpan(w, part)
+		if f.Name != "" {
+			data.Feed = f.Title
+		}
+		subject, err := buildSubject(f, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) > 1 {
+			subject = fmt.Sprintf("%s (%d/%d)", subject, i+1, len(parts))
+		}
+		if *subject_prefix != "" {
+			subject = "[" + *subject_prefix + "] " + subject
+		}
+		if *digest_header {
+			htmlHeader, textHeader := buildHeader(data)
+			htmlBody = htmlHeader + htmlBody
+			textBody = textHeader + textBody
+		}
+		if data.Feed != "" {
+			htmlHeader, textHeader := buildFeedHeader(data)
+			htmlBody = htmlHeader + htmlBody
+			textBody = textHeader + textBody
+		}
+		if more > 0 {
+			htmlFooter, textFooter := buildMoreFooter(f, more)
+			htmlBody += htmlFooter
+			textBody += textFooter
+		}
+		if *email_compat {
+			htmlBody = compatFonts.Replace(htmlBody)
+		}
+
+		emails = append(emails, digestEmail{subject: subject, htmlBody: htmlBody, textBody: textBody, tweets: len(part)})
+	}
+	return emails, nil
+}
+
+// compatFonts replaces the system-ui font stack of the headers and footers
+// with one older email clients understand, for email_compat
+var compatFonts = strings.NewReplacer(
+	"system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif",
+	"'Segoe UI', Helvetica, Arial, sans-serif")
+
+// buildMoreFooter renders the line at the bottom of a truncated digest saying
+// how many more tweets there were, linking to the feed’s timeline
+func buildMoreFooter(f *feed, more int) (string, string) {
+	timelineURL := "https://twitter.com/home"
+	if f.ListID != 0 {
+		timelineURL = fmt.Sprintf("https://twitter.com/i/lists/%d", f.ListID)
+	}
+
+	footer := `
+<div style="margin-bottom: 10px; font: 15px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">
+  <a href="%s" style="color: rgb(27, 149, 224); text-decoration: none;">%s</a>
+</div>`
+	label := fmt.Sprintf(msgs.More, more)
+	return fmt.Sprintf(footer, html.EscapeString(timelineURL), html.EscapeString(label)),
+		fmt.Sprintf("%s: %s\n", label, timelineURL)
+}
+
+// sortTweets returns a copy of tweets sorted oldest first by ID, which
+// increases over time
+func sortTweets(tweets []DigestTweet) []DigestTweet {
+	sorted := make([]DigestTweet, len(tweets))
+	copy(sorted, tweets)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// buildDigest renders tweets oldest first as the HTML and plain-text bodies
+// of the email. They are sorted since tweets from different fetches may be
+// stored in any order.
+func buildDigest(tweets []DigestTweet) (string, string) {
+	sorted := sortTweets(tweets)
+
+	builder := strings.Builder{}
+	textBuilder := strings.Builder{}
+
+	if *group_threads {
+		for _, thread := range groupThreads(sorted) {
+			writeThread(&builder, &textBuilder, thread, 0)
+		}
+	} else {
+		var threads map[int64][]*DigestTweet
+		var continued map[int64]bool
+		if *stitch_self_threads {
+			threads, continued = selfThreads(sorted)
+		}
+		for i := range sorted {
+			if thread, ok := threads[sorted[i].ID]; ok {
+				builder.WriteString(buildSelfThread(thread))
+				textBuilder.WriteString(buildSelfThreadText(thread))
+				continue
+			}
+			if continued[sorted[i].ID] {
+				continue
+			}
+			builder.WriteString(buildTweet(&sorted[i]))
+			textBuilder.WriteString(buildTweetText(&sorted[i]))
+		}
+	}
+
+	return builder.String(), textBuilder.String()
+}
+
+// selfThreads finds the threads among tweets, oldest first, of tweets by one
+// author each replying to their own previous tweet. It returns them by the ID
+// of the tweet starting them, and the IDs of the tweets continuing them.
+// Retweets take no part, and only the oldest reply continues a tweet.
+func selfThreads(tweets []DigestTweet) (map[int64][]*DigestTweet, map[int64]bool) {
+	byID := map[int64]*DigestTweet{}
+	for i := range tweets {
+		if tweets[i].RetweetedStatus == nil && tweets[i].User != nil {
+			byID[tweets[i].ID] = &tweets[i]
+		}
+	}
+
+	next := map[int64]*DigestTweet{}
+	continued := map[int64]bool{}
+	for i := range tweets {
+		tweet := &tweets[i]
+		if byID[tweet.ID] != tweet || tweet.InReplyToUserID != tweet.User.ID {
+			continue
+		}
+		parent, ok := byID[tweet.InReplyToStatusID]
+		if !ok || parent.User.ID != tweet.User.ID || parent.ID >= tweet.ID || next[parent.ID] != nil {
+			continue
+		}
+		next[parent.ID] = tweet
+		continued[tweet.ID] = true
+	}
+
+	threads := map[int64][]*DigestTweet{}
+	for i := range tweets {
+		tweet := &tweets[i]
+		if continued[tweet.ID] || next[tweet.ID] == nil {
+			continue
+		}
+		thread := []*DigestTweet{tweet}
+		for reply := next[tweet.ID]; reply != nil; reply = next[reply.ID] {
+			thread = append(thread, reply)
+		}
+		threads[tweet.ID] = thread
+	}
+	return threads, continued
+}
+
+// threadNode is a tweet and the tweets replying to or quoting it in the same
+// digest
+type threadNode struct {
+	tweet   *DigestTweet
+	replies []*threadNode
+}
+
+// groupThreads arranges tweets, oldest first, into threads of tweets replying
+// to or quoting each other. Tweets whose parent isn’t among tweets start their
+// own thread.
+func groupThreads(tweets []DigestTweet) []*threadNode {
+	nodes := make([]*threadNode, 0, len(tweets))
+	byID := map[int64]*threadNode{}
+	for i := range tweets {
+		node := &threadNode{tweet: &tweets[i]}
+		nodes = append(nodes, node)
+		byID[tweets[i].ID] = node
+		// Replies to a retweeted tweet go under the retweet
+		if retweeted := tweets[i].RetweetedStatus; retweeted != nil {
+			if _, ok := byID[retweeted.ID]; !ok {
+				byID[retweeted.ID] = node
+			}
+		}
+	}
+
+	var threads []*threadNode
+	for _, node := range nodes {
+		tweet := node.tweet
+		if tweet.RetweetedStatus != nil {
+			tweet = tweet.RetweetedStatus
+		}
+		parentID := tweet.InReplyToStatusID
+		if parentID == 0 {
+			parentID = tweet.QuotedStatusID
+		}
+		// Parents are older than their replies, which also rules out cycles
+		if parent, ok := byID[parentID]; ok && parentID < tweet.ID && parent != node {
+			parent.replies = append(parent.replies, node)
+		} else {
+			threads = append(threads, node)
+		}
+	}
+	return threads
+}
+
+// writeThread renders a thread with replies nested under the tweet they
+// reply to, indented by depth
+func writeThread(builder, textBuilder *strings.Builder, thread *threadNode, depth int) {
+	builder.WriteString(buildTweet(thread.tweet))
+	indent := strings.Repeat("    ", depth)
+	for _, line := range strings.SplitAfter(buildTweetText(thread.tweet), "\n") {
+		if strings.TrimSpace(line) != "" {
+			textBuilder.WriteString(indent)
+		}
+		textBuilder.WriteString(line)
+	}
+
+	if len(thread.replies) == 0 {
+		return
+	}
+	builder.WriteString(`
+<div style="border-left: 2px solid rgb(204, 214, 221); margin-left: 50px; padding-left: 10px;">`)
+	for _, reply := range thread.replies {
+		writeThread(builder, textBuilder, reply, depth+1)
+	}
+	builder.WriteString(`
+</div>`)
+}
+
+// digestData describes what a digest covers. It is passed to the subject
+// template.
+type digestData struct {
+	Count      int
+	Start, End time.Time
+	// The window the tweets were stored for, and how many were posted in it.
+	// Catch-up runs can store tweets posted before their window.
+	WindowStart, WindowEnd time.Time
+	InWindow               int
+	// The title of the feed, empty for the single default feed
+	Feed string
+}
+
+// SameDay reports whether the digest starts and ends on the same day
+func (d digestData) SameDay() bool {
+	return d.Start.YearDay() == d.End.YearDay() && d.Start.Year() == d.End.Year()
+}
+
+// digestSpan computes the span of time tweets stored for a window were
+// posted in, in the configured timezone
+func digestSpan(w window, tweets []DigestTweet) digestData {
+	data := digestData{Count: len(tweets), WindowStart: w.start, WindowEnd: w.end}
+	for _, tweet := range tweets {
+		createdAt, err := tweet.CreatedAtTime()
+		if err != nil {
+			continue
+		}
+		if data.Start.IsZero() || createdAt.Before(data.Start) {
+			data.Start = createdAt
+		}
+		if createdAt.After(data.End) {
+			data.End = createdAt
+		}
+		if !createdAt.Before(w.start) && createdAt.Before(w.end) {
+			data.InWindow++
+		}
+	}
+	data.Start = data.Start.In(location)
+	data.End = data.End.In(location)
+	return data
+}
+
+// buildSubject renders the email subject for a digest from the feed’s subject
+// template, or the locale’s
+func buildSubject(f *feed, data digestData) (string, error) {
+	source := f.SubjectTemplate
+	if source == "" {
+		source = msgs.SubjectTemplate
+		if data.Feed != "" {
+			source = "[{{.Feed}}] " + source
+		}
+	}
+	tmpl, err := template.New("subject").Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	builder := strings.Builder{}
+	err = tmpl.Execute(&builder, data)
+	return builder.String(), err
+}
+
+// buildFeedHeader renders the line at the top of the email saying which feed
+// a digest is from, as HTML and plain text
+func buildFeedHeader(data digestData) (string, string) {
+	text := fmt.Sprintf(msgs.FeedDigest, data.Feed)
+	header := `
+<div style="color: rgb(45, 51, 55); margin-bottom: 10px; font: bold 16px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">%s</div>`
+	return fmt.Sprintf(header, html.EscapeString(text)), text + "\n\n"
+}
+
+// buildHeader renders the line at the top of the email saying what a digest
+// covers, as HTML and plain text
+func buildHeader(data digestData) (string, string) {
+	layout := msgs.DateLayout
+	span := fmt.Sprintf(msgs.TweetsPosted, data.Count, data.Start.Format(layout), data.End.Format(layout))
+	if data.Start.IsZero() {
+		span = fmt.Sprintf(msgs.Tweets, data.Count)
+	}
+	var text string
+	if data.InWindow == 0 && !data.WindowStart.IsZero() {
+		text = fmt.Sprintf(msgs.CatchingUp, data.WindowStart.Format(layout), data.WindowEnd.Format(layout), span)
+	} else {
+		text = span + "."
+	}
+
+	header := `
+<div style="color: rgb(136, 153, 166); margin-bottom: 10px; font: 14px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">%s</div>`
+	return fmt.Sprintf(header, html.EscapeString(text)), text + "\n\n"
+}
+
+// unavailableURL links to a tweet by its ID alone, for tweets that came
+// without their author
+const unavailableURL = "https://twitter.com/i/web/status/%d"
+
+// newCardData extracts what is shown of a tweet, for the card template and
+// the other outputs
+func newCardData(tweet *DigestTweet) cardData {
+	if tweet.Unavailable() {
+		return cardData{Unavailable: true, URL: fmt.Sprintf(unavailableURL, tweet.ID), PlainText: msgs.Unavailable}
+	}
+
+	data := cardData{}
+	if tweet.RetweetedStatus != nil {
+		data.RetweetedBy = tweet.User.Name
+		data.RetweetedText = fmt.Sprintf(msgs.Retweeted, tweet.User.Name)
+		data.RetweetedByURL = fmt.Sprintf("https://twitter.com/%s", tweet.User.ScreenName)
+		tweet = tweet.RetweetedStatus
+	}
+	data.Name = tweet.User.Name
+	data.ScreenName = tweet.User.ScreenName
+	data.ProfileURL = fmt.Sprintf("https://twitter.com/%s", tweet.User.ScreenName)
+	data.Avatar = profileImageURL(tweet.User, "reasonably_small")
+	data.URL = fmt.Sprintf("https://twitter.com/%s/status/%d", tweet.User.ScreenName, tweet.ID)
+	data.Time, _ = tweetTime(tweet)
+	if tweet.Edited() {
+		data.EditedText = msgs.Edited
+	}
+	data.Engagement = engagement(tweet)
+	data.PlainText = tweetPlainText(tweet)
+	data.Photos = tweetPhotos(tweet)
+	data.Text = htmltemplate.HTML(tweetText(tweet, data.URL))
+	data.Media = htmltemplate.HTML(buildMedia(tweet))
+	data.Quoted = htmltemplate.HTML(buildQuotedTweet(tweet.QuotedStatus))
+	return data
+}
+
+// avatarSize matches the size Twitter appends to an avatar’s file name
+var avatarSize = regexp.MustCompile(`_(normal|bigger|mini|reasonably_small|200x200|400x400)(\.[A-Za-z0-9]+)?$`)
+
+// profileImageURL returns the URL of a user’s avatar in one of Twitter’s
+// sizes, like normal or reasonably_small, or in its original size if size is
+// empty. URLs without a size, like the default avatars, are left as they are.
+func profileImageURL(user *TweetUser, size string) string {
+	avatar := user.ProfileImageURLHttps
+	u, err := neturl.Parse(avatar)
+	if err != nil || strings.Contains(u.Path, "/default_profile_images/") || !avatarSize.MatchString(u.Path) {
+		return avatar
+	}
+
+	suffix := ""
+	if size != "" {
+		suffix = "_" + size
+	}
+	u.Path = avatarSize.ReplaceAllString(u.Path, suffix+"${2}")
+	return u.String()
+}
+
+// buildTweet renders a tweet as a card
+func buildTweet(tweet *DigestTweet) string {
+	data := newCardData(tweet)
+	if data.Unavailable {
+		return buildUnavailableTweet(data.URL, "margin-bottom")
+	}
+	return executeCard(data)
+}
+
+// buildUnavailableTweet renders a placeholder for a tweet that came without
+// its author, as a box linking to it, spaced from the others by margin
+func buildUnavailableTweet(url, margin string) string {
+	unavailable := `
+<div style="border: 1px solid rgb(204, 214, 221); border-radius: 14px; %s: 10px; max-width: 500px; padding: 10px; font: 14px system-ui, -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Ubuntu, 'Helvetica Neue', sans-serif;">
+  <a href="%s" style="color: rgb(136, 153, 166); text-decoration: none;">%s</a>
+</div>`
+	return fmt.Sprintf(unavailable, margin, html.EscapeString(url), html.EscapeString(msgs.Unavailable))
+}
+
+// executeCard renders card data with the card template, or the default one if
+// it fails
+func executeCard(data cardData) string {
+	data.Avatar = proxyImage(data.Avatar)
+	builder := strings.Builder{}
+	err := cardTemplate.Execute(&builder, data)
+	if err != nil {
+		slog.Warn("Card template failed, using the default one", "event", "card_template_failed", "url", data.URL, "error", err.Error())
+		builder.Reset()
+		fallback := defaultCard
+		if *email_compat {
+			fallback = compatCard
+		}
+		fallback.Execute(&builder, data)
+	}
+	return builder.String()
+}
+
+// buildSelfThread renders a self-thread as one card showing the first tweet,
+// with the text, media and quoted tweets of the others added in turn
+func buildSelfThread(thread []*DigestTweet) string {
+	data := newCardData(thread[0])
+	for _, tweet := range thread[1:] {
+		reply := newCardData(tweet)
+		data.PlainText += "\n\n" + reply.PlainText
+		data.Photos = append(data.Photos, reply.Photos...)
+		data.Text += "<br><br>" + reply.Text
+		data.Media += reply.Media
+		data.Quoted += reply.Quoted
+	}
+	return executeCard(data)
+}
+
+// buildSelfThreadText renders a self-thread as plain text, linking to its
+// first tweet
+func buildSelfThreadText(thread []*DigestTweet) string {
+	first := thread[0]
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("%s (@%s)", first.User.Name, first.User.ScreenName))
+	if posted, ok := tweetTime(first); ok {
+		builder.WriteString(" · " + posted)
+	}
+	builder.WriteString("\n")
+	for i, tweet := range thread {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(tweetPlainText(tweet) + "\n")
+		builder.WriteString(quotedTweetText(tweet.QuotedStatus))
+	}
+	builder.WriteString(fmt.Sprintf("https://twitter.com/%s/status/%d\n\n", first.User.ScreenName, first.ID))
+	return builder.String()
+}
+
+// tweetTime formats when a tweet was posted with time_format, or the locale’s
+// layout, in the configured timezone, reporting false if its creation time
+// can’t be parsed
+func tweetTime(tweet *DigestTweet) (string, bool) {
+	createdAt, err := tweet.CreatedAtTime()
+	if err != nil {
+		return "", false
+	}
+	layout := *time_format
+	if layout == "" {
+		layout = msgs.DateLayout
+	}
+	return createdAt.In(location).Format(layout), true
+}
+
+// buildQuotedTweet renders a quoted tweet as a smaller card nested in a box
+// under the text of the tweet quoting it
+func buildQuotedTweet(tweet *DigestTweet) string {
+	if tweet == nil {
+		return ""
+	}
+	if tweet.User == nil {
+		return buildUnavailableTweet(fmt.Sprintf(unavailableURL, tweet.ID), "margin-top")
+	}
+
+	quoted := `
+      <div style="border: 1px solid rgb(204, 214, 221); border-radius: 14px; margin-top: 10px; max-width: 500px; padding: 10px;">
+        <div style="display: flex;">
+          <a href="%s" style="border-radius: 9999px; flex-shrink: 0; margin-right: 5px; max-height: 20px; min-width: 20px; overflow: hidden;">
+            <img src="%s" style="height: 20px; width: 20px;">
+          </a>
+          <a href="%s" style="color: rgb(45, 51, 55); font-size: 14px; text-decoration: none;">
+            <span style="font-weight: bold;">%s</span>
+            <span style="color: rgb(136, 153, 166);">@%s</span>
+          </a>
+        </div>
+        <div style="font-size: 14px; line-height: 1.3125; margin-top: 5px;">
+          %s
+        </div>%s
+      </div>`
+	if *email_compat {
+		quoted = `
+      <table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%%" style="border: 1px solid #ccd6dd; border-radius: 14px; margin-top: 10px; max-width: 500px;">
+        <tr>
+          <td style="padding: 10px;">
+            <a href="%s"><img src="%s" width="20" height="20" alt="" style="border: 0; border-radius: 10px; height: 20px; vertical-align: middle; width: 20px;"></a>
+            <a href="%s" style="color: #2d3337; font-size: 14px; text-decoration: none;"><b>%s</b> <span style="color: #8899a6;">@%s</span></a>
+            <div style="font-size: 14px; line-height: 1.3125; margin-top: 5px;">
+              %s
+            </div>%s
+          </td>
+        </tr>
+      </table>`
+	}
+	tweeter_url := fmt.Sprintf("https://twitter.com/%s", tweet.User.ScreenName)
+	tweet_url := fmt.Sprintf("https://twitter.com/%s/status/%d", tweet.User.ScreenName, tweet.ID)
+	return fmt.Sprintf(
+		quoted,
+		html.EscapeString(tweeter_url),
+		html.EscapeString(proxyImage(profileImageURL(tweet.User, "normal"))),
+		html.EscapeString(tweeter_url),
+		html.EscapeString(tweet.User.Name),
+		html.EscapeString(tweet.User.ScreenName),
+		tweetText(tweet, tweet_url),
+		buildMedia(tweet))
+}
+
+// buildTweetText renders a tweet as plain text, for clients that don’t display
+// HTML
+func buildTweetText(tweet *DigestTweet) string {
+	if tweet.Unavailable() {
+		return fmt.Sprintf("%s\n"+unavailableURL+"\n\n", msgs.Unavailable, tweet.ID)
+	}
+
+	builder := strings.Builder{}
+	if tweet.RetweetedStatus != nil {
+		builder.WriteString(fmt.Sprintf(msgs.Retweeted+"\n", tweet.User.Name))
+		tweet = tweet.RetweetedStatus
+	}
+
+	builder.WriteString(fmt.Sprintf("%s (@%s)", tweet.User.Name, tweet.User.ScreenName))
+	if posted, ok := tweetTime(tweet); ok {
+		builder.WriteString(" · " + posted)
+	}
+	if tweet.Edited() {
+		builder.WriteString(" · " + msgs.Edited)
+	}
+	builder.WriteString(fmt.Sprintf("\n%s\n", tweetPlainText(tweet)))
+	builder.WriteString(quotedTweetText(tweet.QuotedStatus))
+	if line := engagement(tweet); line != "" {
+		builder.WriteString(line + "\n")
+	}
+	builder.WriteString(fmt.Sprintf("https://twitter.com/%s/status/%d\n\n", tweet.User.ScreenName, tweet.ID))
+
+	return builder.String()
+}
+
+// quotedTweetText renders a quoted tweet as a plain-text quote, or nothing if
+// tweet is nil
+func quotedTweetText(tweet *DigestTweet) string {
+	switch {
+	case tweet == nil:
+		return ""
+	case tweet.User == nil:
+		return "> " + msgs.Unavailable + "\n"
+	}
+	return fmt.Sprintf("> %s (@%s): %s\n", tweet.User.Name, tweet.User.ScreenName, tweetPlainText(tweet))
+}
+
+// engagement returns the line counting a tweet’s likes and retweets when
+// show_engagement is set
+func engagement(tweet *DigestTweet) string {
+	if !*show_engagement {
+		return ""
+	}
+	return fmt.Sprintf(msgs.Likes, compactCount(tweet.FavoriteCount)) + " · " + fmt.Sprintf(msgs.Retweets, compactCount(tweet.RetweetCount))
+}
+
+// compactCount formats a count like Twitter does, as 1.2K or 3.4M from a
+// thousand on
+func compactCount(n int) string {
+	format := func(value float64, suffix string) string {
+		// Rounding down keeps 999,999 from showing as 1000K
+		return strconv.FormatFloat(math.Floor(value*10)/10, 'f', -1, 64) + suffix
+	}
+	switch {
+	case n >= 1000000:
+		return format(float64(n)/1000000, "M")
+	case n >= 1000:
+		return format(float64(n)/1000, "K")
+	default:
+		return strconv.Itoa(n)
+	}
+}
+
+// fullText returns the text of a tweet. Tweets fetched without extended mode
+// only have the legacy Text, which may be truncated, and their entities index
+// into it.
+func fullText(tweet *DigestTweet) string {
+	if tweet.FullText != "" {
+		return tweet.FullText
+	}
+	return tweet.Text
+}
+
+// displayRange returns where the part of a tweet’s text Twitter displays
+// starts and ends, in characters. Replies start with the mentions of the users
+// they reply to, hidden unless show_reply_mentions is set.
+func displayRange(tweet *DigestTweet, text []rune) (int, int) {
+	// Tweets fetched without extended mode have an empty range
+	r := tweet.DisplayTextRange
+	if r == nil || r.End() == 0 || r.Start() < 0 || r.Start() > r.End() || r.End() > len(text) {
+		return 0, len(text)
+	}
+	if *show_reply_mentions {
+		return 0, r.End()
+	}
+	return r.Start(), r.End()
+}
+
+// displayText returns the part of a tweet’s text Twitter displays
+func displayText(tweet *DigestTweet) string {
+	text := []rune(fullText(tweet))
+	start, end := displayRange(tweet, text)
+	return string(text[start:end])
+}
+
+// tweetPlainText returns the displayed text of a tweet with t.co links
+// expanded, and links to its own media or quoted tweet stripped
+func tweetPlainText(tweet *DigestTweet) string {
+	text := displayText(tweet)
+	if tweet.Entities != nil {
+		for _, url := range tweet.Entities.Urls {
+			expanded := stripTracking(url.ExpandedURL)
+			if isQuotedStatusURL(tweet, url) {
+				expanded = ""
+			}
+			text = strings.Replace(text, url.URL, expanded, -1)
+		}
+	}
+	for _, media := range tweetMedia(tweet) {
+		text = strings.Replace(text, media.URL, "", -1)
+	}
+	return strings.TrimSpace(text)
+}
+
+// tweetMedia returns the media entities of a tweet, whose t.co links point
+// back at the tweet’s own media. Tweets may only list them in Entities, or in
+// ExtendedEntities too when they have several.
+func tweetMedia(tweet *DigestTweet) []MediaEntity {
+	var media []MediaEntity
+	if tweet.Entities != nil {
+		media = append(media, tweet.Entities.Media...)
+	}
+	if tweet.ExtendedEntities != nil {
+		media = append(media, tweet.ExtendedEntities.Media...)
+	}
+	return media
+}
+
+// textSpan replaces the characters of a tweet’s text from start up to end
+// with a link to href labelled label, or strips them if href is empty
+type textSpan struct {
+	start, end  int
+	href, label string
+}
+
+// tweetText renders the text of a tweet. t.co links are expanded to where they
+// point, except links to the tweet’s own media or quoted tweet, which are
+// rendered separately and stripped. Hashtags and mentions link to Twitter. The
+// rest of the text is escaped and links to the tweet.
+func tweetText(tweet *DigestTweet, tweetURL string) string {
+	return spliceText(tweet, entityLink, func(segment string) string {
+		return fmt.Sprintf(`<a href="%s" style="color: black; text-decoration: none;">%s</a>`, html.EscapeString(tweetURL), lineBreaks(html.EscapeString(segment)))
+	})
+}
+
+// spliceText renders the displayed text of a tweet, with link rendering the
+// links to expanded t.co links, hashtags and mentions, and plain rendering the
+// text between them. Links to the tweet’s own media or quoted tweet are
+// stripped.
+func spliceText(tweet *DigestTweet, link func(href, label string) string, plain func(segment string) string) string {
+	text := []rune(fullText(tweet))
+	start, end := displayRange(tweet, text)
+
+	var spans []textSpan
+	if tweet.Entities != nil {
+		for _, url := range tweet.Entities.Urls {
+			span := textSpan{start: url.Indices.Start(), end: url.Indices.End()}
+			if !isQuotedStatusURL(tweet, url) {
+				span.href = stripTracking(url.ExpandedURL)
+				span.label = url.DisplayURL
+			}
+			spans = append(spans, span)
+		}
+		for _, hashtag := range tweet.Entities.Hashtags {
+			spans = append(spans, entitySpan(text, hashtag.Indices,
+				fmt.Sprintf("https://twitter.com/hashtag/%s", neturl.PathEscape(hashtag.Text))))
+		}
+		for _, mention := range tweet.Entities.UserMentions {
+			spans = append(spans, entitySpan(text, mention.Indices,
+				fmt.Sprintf("https://twitter.com/%s", mention.ScreenName)))
+		}
+	}
+	for _, media := range tweetMedia(tweet) {
+		spans = append(spans, textSpan{start: media.Indices.Start(), end: media.Indices.End()})
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var segments []string
+	var links []string
+	pos := start
+	for _, span := range spans {
+		// Photos in the same tweet all share one link
+		if span.start < pos || span.end < span.start || span.end > end {
+			continue
+		}
+		segment := string(text[pos:span.start])
+		rendered := ""
+		if span.href == "" {
+			segment = strings.TrimRightFunc(segment, unicode.IsSpace)
+		} else {
+			rendered = link(span.href, span.label)
+		}
+		segments = append(segments, segment)
+		links = append(links, rendered)
+		pos = span.end
+	}
+	segments = append(segments, string(text[pos:end]))
+
+	builder := strings.Builder{}
+	for i, segment := range segments {
+		if segment != "" {
+			builder.WriteString(plain(segment))
+		}
+		if i < len(links) {
+			builder.WriteString(links[i])
+		}
+	}
+
+	return builder.String()
+}
+
+// newlineRuns matches three or more line breaks in a row
+var newlineRuns = regexp.MustCompile(`(\r?\n){3,}`)
+
+// lineBreaks turns the line breaks in escaped text into <br> tags, collapsing
+// long runs of them into a single blank line
+func lineBreaks(text string) string {
+	text = newlineRuns.ReplaceAllString(text, "\n\n")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\n", "<br>")
+}
+
+// entitySpan returns a span linking the text of an entity to href
+func entitySpan(text []rune, indices Indices, href string) textSpan {
+	span := textSpan{start: indices.Start(), end: indices.End()}
+	if span.start >= 0 && span.start <= span.end && span.end <= len(text) {
+		span.href = href
+		span.label = string(text[span.start:span.end])
+	}
+	return span
+}
+
+// entityLink renders a link found in the text of a tweet
+func entityLink(href, label string) string {
+	return fmt.Sprintf(`<a href="%s" style="color: rgb(27, 149, 224); text-decoration: none;">%s</a>`, html.EscapeString(href), html.EscapeString(label))
+}
+
+// defaultTrackingParams are the query parameters strip-tracking-params strips
+// unless tracking-params is set
+var defaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "mc_cid", "mc_eid", "igshid", "_hsenc", "_hsmi", "mkt_tok"}
+
+// stripTracking removes tracking query parameters from a link when
+// strip-tracking-params is set. Only the query is changed, the other
+// parameters are kept as they were written and in the same order.
+func stripTracking(href string) string {
+	if !*strip_tracking_params {
+		return href
+	}
+	params := []string(tracking_params)
+	if len(params) == 0 {
+		params = defaultTrackingParams
+	}
+
+	rest, fragment := href, ""
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest, fragment = rest[:i], rest[i:]
+	}
+	i := strings.Index(rest, "?")
+	if i < 0 {
+		return href
+	}
+	base, query := rest[:i], rest[i+1:]
+
+	var kept []string
+	for _, pair := range strings.Split(query, "&") {
+		name := strings.SplitN(pair, "=", 2)[0]
+		if unescaped, err := neturl.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !isTrackingParam(name, params) {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == 0 {
+		return base + fragment
+	}
+	return base + "?" + strings.Join(kept, "&") + fragment
+}
+
+// isTrackingParam reports whether a query parameter is one of params, which
+// match any suffix when they end with *
+func isTrackingParam(name string, params []string) bool {
+	for _, param := range params {
+		if prefix := strings.TrimSuffix(param, "*"); prefix != param {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuotedStatusURL reports whether url is the permalink of the tweet quoted by
+// tweet
+func isQuotedStatusURL(tweet *DigestTweet, url URLEntity) bool {
+	return tweet.QuotedStatusID != 0 &&
+		strings.Contains(url.ExpandedURL, fmt.Sprintf("/status/%d", tweet.QuotedStatusID))
+}
+
+// tweetPhotos returns the URLs of the photos attached to a tweet
+func tweetPhotos(tweet *DigestTweet) []string {
+	if tweet.ExtendedEntities == nil {
+		return nil
+	}
+
+	var photos []string
+	for _, media := range tweet.ExtendedEntities.Media {
+		if media.Type == "photo" {
+			photos = append(photos, mediaSrc(media))
+		}
+	}
+	return photos
+}
+
+// buildMedia renders the photos attached to a tweet as a grid of images,
+// followed by the preview images of its videos and animated GIFs
+func buildMedia(tweet *DigestTweet) string {
+	builder := strings.Builder{}
+
+	photos := tweetPhotos(tweet)
+	if len(photos) > 0 && *email_compat {
+		builder.WriteString(buildCompatPhotos(photos))
+	} else if len(photos) > 0 {
+		// A single photo takes the full width, several are laid out two per row
+		width := "100%"
+		if len(photos) > 1 {
+			width = "49%"
+		}
+
+		builder.WriteString(`
+      <div style="display: flex; flex-wrap: wrap; justify-content: space-between; margin-top: 10px; max-width: 500px;">`)
+		for _, photo := range photos {
+			builder.WriteString(fmt.Sprintf(`
+        <img src="%s" style="border-radius: 14px; margin-bottom: 4px; max-width: 500px; width: %s;">`, html.EscapeString(proxyImage(photo)), width))
+		}
+		builder.WriteString(`
+      </div>`)
+	}
+
+	if tweet.ExtendedEntities != nil {
+		tweetURL := fmt.Sprintf("https://twitter.com/%s/status/%d", tweet.User.ScreenName, tweet.ID)
+		for _, media := range tweet.ExtendedEntities.Media {
+			if media.Type == "video" || media.Type == "animated_gif" {
+				builder.WriteString(buildVideo(media, tweetURL))
+			}
+		}
+	}
+
+	return builder.String()
+}
+
+// buildVideo renders the preview image of a video or animated GIF with a play
+// button over it, linking to the tweet since email can’t play videos
+func buildVideo(media MediaEntity, tweetURL string) string {
+	preview := mediaSrc(media)
+	if preview == "" {
+		preview = strings.Replace(media.MediaURL, "http://", "https://", 1)
+	}
+	if preview == "" {
+		return ""
+	}
+
+	// Animated GIFs are labelled as such, videos with their duration
+	badge := "GIF"
+	if media.Type == "video" {
+		badge = ""
+		if duration := media.VideoInfo.DurationMillis / 1000; duration > 0 {
+			badge = fmt.Sprintf("%d:%02d", duration/60, duration%60)
+		}
+	}
+	if *email_compat {
+		return buildCompatVideo(badge, tweetURL, preview)
+	}
+	if badge != "" {
+		badge = fmt.Sprintf(`
+          <span style="background: rgba(0, 0, 0, 0.75); border-radius: 4px; bottom: 12px; color: white; font-size: 13px; left: 8px; padding: 1px 5px; position: absolute;">%s</span>`, badge)
+	}
+
+	video := `
+      <a href="%s" style="display: block; margin-top: 10px; max-width: 500px; position: relative;">
+        <img src="%s" style="border-radius: 14px; display: block; width: 100%%;">
+        <span style="background: rgb(27, 149, 224); border: 4px solid white; border-radius: 9999px; color: white; font-size: 24px; height: 56px; left: 50%%; line-height: 56px; margin: -32px 0 0 -32px; position: absolute; text-align: center; top: 50%%; width: 56px;">&#9654;</span>%s
+      </a>`
+	return fmt.Sprintf(video, html.EscapeString(tweetURL), html.EscapeString(proxyImage(preview)), badge)
+}
+
+// buildCompatPhotos lays out photos for email_compat in a table, one per row
+// or two when there are several, with their widths also set as attributes
+func buildCompatPhotos(photos []string) string {
+	perRow, width := 1, 500
+	if len(photos) > 1 {
+		perRow, width = 2, 246
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString(`
+      <table role="presentation" border="0" cellpadding="0" cellspacing="0" style="margin-top: 10px;">`)
+	for start := 0; start < len(photos); start += perRow {
+		builder.WriteString(`
+        <tr>`)
+		for i := start; i < start+perRow && i < len(photos); i++ {
+			builder.WriteString(fmt.Sprintf(`
+          <td valign="top" style="padding: 0 4px 4px 0;"><img src="%s" width="%d" alt="" style="border: 0; border-radius: 14px; display: block; max-width: 100%%; width: %dpx;"></td>`, html.EscapeString(proxyImage(photos[i])), width, width))
+		}
+		builder.WriteString(`
+        </tr>`)
+	}
+	builder.WriteString(`
+      </table>`)
+	return builder.String()
+}
+
+// buildCompatVideo renders the preview of a video or animated GIF for
+// email_compat, with the play button and badge in a caption under it since
+// older clients can’t overlay them
+func buildCompatVideo(badge, tweetURL, preview string) string {
+	caption := "&#9654;"
+	if badge != "" {
+		caption += " " + html.EscapeString(badge)
+	}
+	video := `
+      <a href="%s" style="display: block; margin-top: 10px; text-decoration: none;">
+        <img src="%s" width="500" alt="" style="border: 0; border-radius: 14px; display: block; max-width: 100%%; width: 500px;">
+        <span style="color: #1b95e0; font-size: 13px;">%s</span>
+      </a>`
+	return fmt.Sprintf(video, html.EscapeString(tweetURL), html.EscapeString(proxyImage(preview)), caption)
+}
+
+// proxyImage returns the URL loading an image through image_proxy_base when it
+// is set. Only http and https images are proxied.
+func proxyImage(src string) string {
+	if *image_proxy_base == "" {
+		return src
+	}
+	u, err := neturl.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return src
+	}
+	return *image_proxy_base + neturl.QueryEscape(src)
+}
+
+// defineConfig defines the flags of the config variables, setting them to
+// their defaults
+func defineConfig() *flag.FlagSet {
+	fs := flag.NewFlagSet("twitter-to-email", flag.ExitOnError)
+
+	bucket = fs.String("bucket", "", "S3 Bucket, or file://<dir> to keep tweets in a local directory")
+	consumer_api_key = fs.String("consumer-api-key", "", "Twitter Consumer API Key")
+	consumer_api_secret_key = fs.String("consumer-api-secret-key", "", "Twitter Consumer API Secret Key")
+	access_token = fs.String("access-token", "", "Twitter Access token")
+	access_token_secret = fs.String("access-token-secret", "", "Twitter Access token secret")
+	user_agent = fs.String("user-agent", "", "User-Agent header sent to the Twitter API instead of Go’s default one")
+	bearer_token = fs.String("bearer-token", "", "Twitter app-only bearer token, used instead of the consumer keys and access token for List timelines")
+	email = fs.String("email", "", "Email, used as both sender and recipient unless from or recipients are set")
+	recipients = stringList{}
+	fs.Var(&recipients, "recipients", "Comma-separated list of addresses to send the digest to")
+	cc = stringList{}
+	fs.Var(&cc, "cc", "Comma-separated list of addresses to copy every digest to")
+	bcc = stringList{}
+	fs.Var(&bcc, "bcc", "Comma-separated list of addresses to blind copy every digest to")
+	from = fs.String("from", "", "Address to send the digest from")
+	from_name = fs.String("from-name", "", "Display name of the sender, like Twitter Digest")
+	key_prefix = fs.String("key-prefix", "tweets/", "Prefix of the keys everything is stored at, to share a bucket between deployments")
+	last_run_key = fs.String("last-run-key", "", "Key of the heartbeat recording when each run finished, its status and counts, <key-prefix>last_run.json by default")
+	config_s3 = fs.String("config-s3", "", "S3 URI like s3://bucket/config.json of a JSON config file, under the environment and config.json")
+	feeds_file = fs.String("feeds-file", "", "JSON file defining several feeds, each with a name, list-id, recipients and subject-template")
+	store = fs.String("store", "s3", "Where to keep tweets between runs: s3, or fs for files under store-dir")
+	s3_endpoint = fs.String("s3-endpoint", "", "S3 endpoint to use instead of AWS, for S3-compatible services like localstack or MinIO")
+	pretty_store = fs.Bool("pretty-store", false, "Store tweets as indented JSON, for reading them in the bucket, instead of minified")
+	s3_force_path_style = fs.Bool("s3-force-path-style", false, "Address the bucket in the URL path instead of the host name, as most S3-compatible services require")
+	s3_sse = fs.String("s3-sse", "", "Server-side encryption of stored objects: AES256 or aws:kms, none when empty")
+	s3_kms_key_id = fs.String("s3-kms-key-id", "", "KMS key to encrypt stored objects with when s3-sse is aws:kms, the AWS managed key when empty")
+	store_dir = fs.String("store-dir", "tweets-store", "Directory to keep tweets in with the fs store")
+	list_id = fs.Int64("list-id", 0, "ID of a Twitter List to digest instead of the home timeline")
+	output = stringList{}
+	fs.Var(&output, "output", "Comma-separated list of how to deliver digests: email, rss for an Atom feed stored next to the tweets, markdown for a Markdown digest stored next to each window’s tweets, or slack. Defaults to email")
+	slack_webhook_url = fs.String("slack-webhook-url", "", "Slack incoming webhook to post digests to with the slack output")
+	mailer = fs.String("mailer", "ses", "How to send email: ses or smtp")
+	smtp_host = fs.String("smtp-host", "", "SMTP server to send email through with the smtp mailer")
+	smtp_port = fs.Int("smtp-port", 587, "Port of the SMTP server")
+	smtp_user = fs.String("smtp-user", "", "User to authenticate to the SMTP server as, if any")
+	smtp_pass = fs.String("smtp-pass", "", "Password to authenticate to the SMTP server with")
+	raw_email = fs.Bool("raw-email", false, "Send through SES as a raw MIME message, which can carry the list-unsubscribe and reply-to headers")
+	list_unsubscribe = fs.String("list-unsubscribe", "", "List-Unsubscribe header of the email, like <mailto:me@example.com?subject=unsubscribe>, with raw-email or the smtp mailer")
+	reply_to = fs.String("reply-to", "", "Reply-To header of the email, with raw-email or the smtp mailer")
+	mode = fs.String("mode", "digest", "How tweets are delivered: digest, once per window, or realtime, whatever is new on each run")
+	rolling = fs.Bool("rolling", false, "Deprecated, set mode to realtime instead")
+	max_age = fs.Duration("max-age", 24*time.Hour, "Leave tweets posted this long before the window being emailed out of its digest, except when catching up. 0 keeps them")
+	window_hours = fs.Int("window-hours", 8, "Length of each digest window in hours, must divide 24")
+	max_lookback_windows = fs.Int("max-lookback-windows", 9, "Number of windows to look back through for the last stored one when a window starts, 0 to never email a previous window")
+	timezone = fs.String("timezone", "", "IANA timezone used for digest windows, UTC when empty")
+	image_proxy_base = fs.String("image-proxy-base", "", "URL that image URLs in the email are appended to, query-escaped, like https://proxy.example.com/?url=, to load them through an image proxy")
+	layout = fs.String("layout", "full", "Layout of the tweet cards: full, or compact for smaller avatars and tighter spacing")
+	mirror_media = fs.Bool("mirror-media", false, "Copy the photos and video previews of tweets into the store under media/ when they are fetched, and link presigned URLs of the copies in the email")
+	mirror_media_expiry = fs.Duration("mirror-media-expiry", maxPresignExpiry, "How long the presigned URLs of mirrored media stay valid, at most 168h")
+	archive_html = fs.Bool("archive-html", false, "Also store the HTML of each email sent under digests/ in the bucket, as a browsable archive")
+	email_compat = fs.Bool("email-compat", false, "Lay out the email with tables and inline styles that older email clients like Outlook render, instead of flex")
+	template_file = fs.String("template-file", "", "Go html/template file rendering each tweet card, instead of the default one")
+	time_format = fs.String("time-format", "", "Go time layout for when each tweet was posted, in the configured timezone, the locale’s by default")
+	locale = fs.String("locale", "en", "Language of the digest’s own text: "+localeNames())
+	subject_template = fs.String("subject-template", "", "Go text/template for the email subject, with .Count, .Start, .End, .WindowStart, .WindowEnd, .InWindow and .Feed")
+	subject_prefix = fs.String("subject-prefix", "", "Tag prepended verbatim in brackets to every email subject, like [prefix], for filtering")
+	store_retries = fs.Int("store-retries", 3, "Number of times to retry merging tweets stored by another run at the same time")
+	twitter_retries = fs.Int("twitter-retries", 3, "Number of times to retry rate limited or failed Twitter calls")
+	twitter_max_backoff = fs.Duration("twitter-max-backoff", 30*time.Second, "Longest time to wait before retrying a Twitter call")
+	aws_retries = fs.Int("aws-retries", 3, "Number of times to retry throttled or failed S3 and SES calls")
+	aws_max_backoff = fs.Duration("aws-max-backoff", 5*time.Second, "Longest time to wait before retrying an S3 or SES call")
+	exclude_retweets = fs.Bool("exclude-retweets", false, "Leave retweets out of the digest")
+	exclude_replies = fs.Bool("exclude-replies", false, "Leave replies out of the digest")
+	send_empty_digest = fs.Bool("send-empty-digest", false, "Send an email saying there are no new tweets when a digest would have none, to show runs still work")
+	digest_header = fs.Bool("digest-header", false, "Start the email with a line saying when its tweets were posted, and whether they are catching up on older ones")
+	exclude_quoted = fs.Bool("exclude-quoted", false, "Leave out tweets already shown quoted by another tweet of the digest")
+	collapse_duplicate_rt = fs.Bool("collapse-duplicate-rt", false, "Show a tweet retweeted by several people once, crediting all of them")
+	show_engagement = fs.Bool("show-engagement", false, "Show the like and retweet counts of each tweet under its text")
+	stitch_self_threads = fs.Bool("stitch-self-threads", false, "Show a thread of tweets by one author replying to themselves as one card, unless group-threads is set")
+	group_threads = fs.Bool("group-threads", false, "Nest replies and quotes under the tweet they reply to when it is in the same digest")
+	mute_users = stringList{}
+	fs.Var(&mute_users, "mute-users", "Comma-separated list of screen names whose tweets and retweets are left out of the digest")
+	mute_keywords = stringList{}
+	fs.Var(&mute_keywords, "mute-keywords", "Comma-separated list of words or phrases, tweets containing any of them are left out of the digest")
+	only_users = stringList{}
+	fs.Var(&only_users, "only-users", "Comma-separated list of screen names, only tweets by them, or retweets of them, are kept in the digest when set")
+	only_users_retweets = fs.Bool("only-users-retweets", false, "Also keep retweets by only-users of other users’ tweets")
+	show_reply_mentions = fs.Bool("show-reply-mentions", false, "Show the mentions a reply starts with, which Twitter hides")
+	strip_tracking_params = fs.Bool("strip-tracking-params", false, "Strip tracking query parameters like utm_source from the links in tweets")
+	tracking_params = stringList{}
+	fs.Var(&tracking_params, "tracking-params", "Comma-separated list of query parameters stripped by strip-tracking-params, a trailing * matching any suffix. Defaults to "+strings.Join(defaultTrackingParams, ","))
+	max_tweets_per_email = fs.Int("max-tweets-per-email", 0, "Most tweets to put in one email, unlimited when 0")
+	overflow = fs.String("overflow", "split", "What to do with a digest over max-tweets-per-email: split it into several emails, or truncate it")
+	dry_run = fs.Bool("dry-run", false, "Print the email instead of sending it")
+	catch_up_start = fs.String("catch-up-start", "", "Backfill the windows from this time on instead of fetching new tweets, as RFC 3339 or 2006-01-02 15:04 in the configured timezone")
+	catch_up_end = fs.String("catch-up-end", "", "End of the windows to backfill, now by default")
+	dry_run_file = fs.String("dry-run-file", "", "File to write the email to in dry-run mode, instead of stdout")
+	log_level = fs.String("log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	metrics_namespace = fs.String("metrics-namespace", "TwitterToEmail", "CloudWatch namespace for metrics, empty to disable them")
+	request_timeout = fs.Duration("request-timeout", 10*time.Second, "Longest time to wait for each AWS or Twitter call")
+	local = fs.Bool("local", false, "Run once and exit instead of waiting for Lambda invocations")
+	serve = fs.String("serve", "", "Address to serve a preview of each feed’s current window on, like :8080, instead of running")
+	selftest = fs.Bool("selftest", false, "Check the Twitter credentials, the store and the SES identity, then exit")
+	api_version = fs.String("api-version", "1.1", "Twitter API version to fetch the home timeline with: 1.1 or 2")
+	max_pages = fs.Int("max-pages", 4, "Maximum number of timeline pages of count tweets to fetch per run")
+	count = fs.Int("count", maxCount, "Number of tweets to request per timeline page, at most 200")
+
+	return fs
+}
+
+// getConfig populates the config variables from the environment, a JSON file
+// and optionally a JSON object in S3, and checks that they are usable
+func getConfig() error {
+	fs := defineConfig()
+
+	// Environment variables like T2E_CONSUMER_API_KEY take precedence over
+	// config.json: flags set from the environment count as provided when the
+	// config file is parsed, so it doesn’t override them.
+	err := ff.Parse(fs, []string{},
+		ff.WithEnvVarPrefix("T2E"))
+	if err != nil {
+		return err
+	}
+	// The config file is optional when everything is set in the environment
+	err = ff.Parse(fs, []string{},
+		ff.WithConfigFile("config.json"),
+		ff.WithConfigFileParser(ff.JSONParser))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if *config_s3 != "" {
+		err = loadS3Config(fs, *config_s3)
+		if err != nil {
+			return fmt.Errorf("invalid config-s3 %q: %v", *config_s3, err)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*log_level)); err != nil {
+		return fmt.Errorf("invalid log-level %q: %v", *log_level, err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+
+	if len(recipients) == 0 {
+		recipients.Set(*email)
+	}
+	if *from == "" {
+		from = email
+	}
+
+	if len(output) == 0 {
+		output.Set("email")
+	}
+	outputs = map[string]bool{}
+	for _, o := range output {
+		switch o {
+		case "email", "rss", "markdown", "slack":
+			outputs[o] = true
+		case "both":
+			// Before slack was added, output was one of email, rss or both
+			outputs["email"] = true
+			outputs["rss"] = true
+		default:
+			return fmt.Errorf("invalid output %q: must be email, rss, markdown or slack", o)
+		}
+	}
+
+	type option struct {
+		name  string
+		value string
+	}
+	var required []option
+	if outputs["email"] {
+		required = append(required, option{"email", *from})
+	}
+	if *bearer_token == "" {
+		required = append(required,
+			option{"consumer-api-key", *consumer_api_key},
+			option{"consumer-api-secret-key", *consumer_api_secret_key},
+			option{"access-token", *access_token},
+			option{"access-token-secret", *access_token_secret})
+	}
+	if *store == "s3" {
+		required = append(required, option{"bucket", *bucket})
+	}
+	if outputs["slack"] {
+		required = append(required, option{"slack-webhook-url", *slack_webhook_url})
+	}
+	var missing []string
+	for _, option := range required {
+		if option.value == "" {
+			missing = append(missing, option.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required configuration: %s", strings.Join(missing, ", "))
+	}
+
+	switch *mailer {
+	case "ses":
+	case "smtp":
+		if *smtp_host == "" {
+			return fmt.Errorf("missing required configuration: smtp-host")
+		}
+	default:
+		return fmt.Errorf("invalid mailer %q: must be ses or smtp", *mailer)
+	}
+
+	if *api_version != "1.1" && *api_version != "2" {
+		return fmt.Errorf("invalid api-version %q: must be 1.1 or 2", *api_version)
+	}
+
+	switch *s3_sse {
+	case "", s3.ServerSideEncryptionAes256:
+		if *s3_kms_key_id != "" {
+			return fmt.Errorf("s3-kms-key-id requires s3-sse to be %s", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("invalid s3-sse %q: must be %s or %s", *s3_sse, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+
+	if *image_proxy_base != "" {
+		u, err := neturl.Parse(*image_proxy_base)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid image-proxy-base %q: must be an http or https URL", *image_proxy_base)
+		}
+	}
+
+	if *overflow != "split" && *overflow != "truncate" {
+		return fmt.Errorf("invalid overflow %q: must be split or truncate", *overflow)
+	}
+
+	modeSet := false
+	fs.Visit(func(f *flag.Flag) {
+		modeSet = modeSet || f.Name == "mode"
+	})
+	if err := resolveMode(modeSet); err != nil {
+		return err
+	}
+	if *count < 1 || *count > maxCount {
+		return fmt.Errorf("invalid count %d: must be between 1 and %d", *count, maxCount)
+	}
+	if *window_hours <= 0 || 24%*window_hours != 0 {
+		return fmt.Errorf("invalid window-hours %d: must divide 24", *window_hours)
+	}
+	if *mirror_media_expiry <= 0 || *mirror_media_expiry > maxPresignExpiry {
+		return fmt.Errorf("invalid mirror-media-expiry %s: must be positive and at most %s", *mirror_media_expiry, maxPresignExpiry)
+	}
+	if *max_lookback_windows < 0 {
+		return fmt.Errorf("invalid max-lookback-windows %d: must not be negative", *max_lookback_windows)
+	}
+
+	var ok bool
+	msgs, ok = locales[*locale]
+	if !ok {
+		return fmt.Errorf("invalid locale %q: must be one of %s", *locale, localeNames())
+	}
+
+	location, err = time.LoadLocation(*timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %v", *timezone, err)
+	}
+
+	if *catch_up_start != "" || *catch_up_end != "" {
+		if _, _, err := parseCatchUp(*catch_up_start, *catch_up_end); err != nil {
+			return err
+		}
+	}
+
+	if outputs["email"] {
+		sender, err := fromAddress(*from, *from_name)
+		if err != nil {
+			return err
+		}
+		from = &sender
+	}
+	if *reply_to != "" {
+		if _, err := mail.ParseAddress(*reply_to); err != nil {
+			return fmt.Errorf("invalid reply-to address %q: %v", *reply_to, err)
+		}
+	}
+	ccAddresses, err = parseAddressList(strings.Join(cc, ","))
+	if err != nil {
+		return fmt.Errorf("invalid cc: %v", err)
+	}
+	bccAddresses, err = parseAddressList(strings.Join(bcc, ","))
+	if err != nil {
+		return fmt.Errorf("invalid bcc: %v", err)
+	}
+
+	*key_prefix = normalizeKeyPrefix(*key_prefix)
+
+	feeds, err = loadFeeds()
+	if err != nil {
+		return err
+	}
+
+	tweetStore, err = newStore()
+	if err != nil {
+		return err
+	}
+
+	switch *layout {
+	case "full":
+		cardTemplate = defaultCard
+		if *email_compat {
+			cardTemplate = compatCard
+		}
+	case "compact":
+		cardTemplate = compactCard
+		if *email_compat {
+			cardTemplate = compactCompatCard
+		}
+	default:
+		return fmt.Errorf("invalid layout %q: must be full or compact", *layout)
+	}
+	if *template_file != "" {
+		cardTemplate, err = loadCardTemplate(*template_file)
+		if err != nil {
+			return fmt.Errorf("invalid template-file %q: %v", *template_file, err)
+		}
+	}
+
+	return nil
+}
+
+// loadS3Config sets the flags that weren’t set yet from the JSON config
+// object at uri, so that it can be changed without redeploying
+func loadS3Config(fs *flag.FlagSet, uri string) error {
+	u, err := neturl.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "s3" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return errors.New("must be like s3://bucket/key")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *request_timeout)
+	defer cancel()
+	result, err := s3.New(sess, s3Config()).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+	return parseUnsetConfig(fs, result.Body)
+}
+
+// parseUnsetConfig sets the flags that weren’t set yet from a JSON config, as
+// ff.Parse does with a config file
+func parseUnsetConfig(fs *flag.FlagSet, r io.Reader) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	return ff.JSONParser(r, func(name, value string) error {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config flag %q not defined", name)
+		}
+		if set[name] {
+			return nil
+		}
+		return fs.Set(name, value)
+	})
+}
+
+// loadFeeds returns the feeds defined in feeds_file, or a single feed from the
+// list-id, recipients and subject-template options when it isn’t set. Feeds
+// without recipients or a subject template use those options instead.
+func loadFeeds() ([]*feed, error) {
+	if *feeds_file == "" {
+		f := &feed{ListID: *list_id}
+		return []*feed{f}, parseFeed(f)
+	}
+
+	file, err := os.Open(*feeds_file)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var loaded []*feed
+	err = json.NewDecoder(file).Decode(&loaded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feeds-file %s: %v", *feeds_file, err)
+	}
+	if len(loaded) == 0 {
+		return nil, fmt.Errorf("invalid feeds-file %s: no feeds defined", *feeds_file)
+	}
+
+	names := map[string]bool{}
+	for _, f := range loaded {
+		// Names become part of S3 keys
+		if f.Name == "" || strings.Contains(f.Name, "/") {
+			return nil, fmt.Errorf("invalid feeds-file %s: feed name %q must be non-empty and without slashes", *feeds_file, f.Name)
+		}
+		if names[f.Name] {
+			return nil, fmt.Errorf("invalid feeds-file %s: feed %s defined twice", *feeds_file, f.Name)
+		}
+		names[f.Name] = true
+
+		if err := parseFeed(f); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", f.Name, err)
+		}
+	}
+	return loaded, nil
+}
+
+// parseFeed fills in a feed’s defaults and parses its recipients
+func parseFeed(f *feed) error {
+	if len(f.Recipients) == 0 {
+		f.Recipients = recipients
+	}
+	if f.Title == "" {
+		f.Title = f.Name
+	}
+	if f.SubjectTemplate == "" {
+		f.SubjectTemplate = *subject_template
+	}
+
+	if *bearer_token != "" && f.ListID == 0 {
+		return fmt.Errorf("bearer-token can’t be used with the home timeline, which requires user context: set list-id or use an access token")
+	}
+
+	if *api_version == "2" && f.ListID != 0 {
+		return fmt.Errorf("api-version 2 only supports the home timeline: use api-version 1.1 for list-id %d", f.ListID)
+	}
+
+	var err error
+	f.toAddresses, err = parseAddressList(strings.Join(f.Recipients, ","))
+	if err != nil {
+		return fmt.Errorf("invalid recipients: %v", err)
+	}
+	if len(f.toAddresses) == 0 && outputs["email"] {
+		return fmt.Errorf("missing required configuration: recipients")
+	}
+	return nil
+}
+
+// parseCatchUp parses the times bounding the windows to backfill. The end
+// defaults to now.
+func parseCatchUp(start, end string) (time.Time, time.Time, error) {
+	if start == "" {
+		return time.Time{}, time.Time{}, errors.New("catch-up-start is required to catch up")
+	}
+	startTime, err := parseTime(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid catch-up-start %q: %v", start, err)
+	}
+
+	endTime := clock().In(location)
+	if end != "" {
+		endTime, err = parseTime(end)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid catch-up-end %q: %v", end, err)
+		}
+	}
+
+	if !endTime.After(startTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("catch-up-end %s is not after catch-up-start %s", endTime, startTime)
+	}
+	return startTime, endTime, nil
+}
+
+// parseTime parses a time as RFC 3339, or as a date and time of day in the
+// configured timezone
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", value, location)
+}
+
+// stringList is a flag holding a comma-separated list. Setting it again
+// appends to the list, since ff sets a flag once for each comma-separated
+// value of its environment variable.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// parseAddressList parses a comma-separated list of email addresses
+func parseAddressList(list string) ([]*string, error) {
+	var addresses []*string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, fmt.Errorf("%q: %v", address, err)
+		}
+		addresses = append(addresses, aws.String(address))
+	}
+	return addresses, nil
+}
+
+// inLambda reports whether we are running inside the AWS Lambda runtime
+func inLambda() bool {
+	return os.Getenv("_LAMBDA_SERVER_PORT") != "" || os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+func main() {
+	if err := getConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *selftest {
+		if !selfTest(context.Background()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *serve != "" {
+		log.Fatal(servePreview(*serve))
+	}
+
+	if *local || !inLambda() {
+		result, err := handleInvocation(context.Background(), Invocation{
+			CatchUpStart: *catch_up_start,
+			CatchUpEnd:   *catch_up_end,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Run finished", "event", "run_finished", "result", result)
+		return
+	}
+
+	lambda.Start(handleInvocation)
 }
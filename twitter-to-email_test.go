@@ -1,11 +1,2146 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+)
 
 func TestFetchTweets(t *testing.T) {
-	getConfig()
-	err := fetchTweets()
+	if err := getConfig(); err != nil {
+		t.Fatalf("There was a problem with the configuration: %v", err)
+	}
+	_, err := fetchTweets(context.Background())
 	if err != nil {
 		t.Errorf("There was a problem: %v", err)
 	}
 }
+
+func TestBuildTweetEscapesText(t *testing.T) {
+	defineConfig()
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: `<script>alert("hi")</script> 1 < 2 && 3 > 2`,
+		User: &TweetUser{
+			Name:       "<b>Mallory</b>",
+			ScreenName: "mallory",
+		},
+	}
+
+	html := buildTweet(&tweet)
+	for _, unsafe := range []string{"<script>", "<b>Mallory", "1 < 2", "&& 3"} {
+		if strings.Contains(html, unsafe) {
+			t.Errorf("Output contains unescaped %q: %s", unsafe, html)
+		}
+	}
+	for _, escaped := range []string{"&lt;script&gt;", "&lt;b&gt;Mallory&lt;/b&gt;", "1 &lt; 2 &amp;&amp; 3 &gt; 2"} {
+		if !strings.Contains(html, escaped) {
+			t.Errorf("Output is missing %q: %s", escaped, html)
+		}
+	}
+}
+
+func TestBuildTweetLegacyText(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	alice := &TweetUser{Name: "Alice", ScreenName: "alice"}
+
+	tweet := DigestTweet{ID: 1, Text: "Only the legacy text", User: alice}
+	if html := buildTweet(&tweet); !strings.Contains(html, "Only the legacy text") {
+		t.Errorf("Output is missing the legacy text: %s", html)
+	}
+	if text := buildTweetText(&tweet); !strings.Contains(text, "Only the legacy text") {
+		t.Errorf("Plain text is missing the legacy text: %s", text)
+	}
+
+	retweet := DigestTweet{
+		ID:   3,
+		Text: "RT @alice: A long tweet that got trunc…",
+		User: &TweetUser{Name: "Bob", ScreenName: "bob"},
+		RetweetedStatus: &DigestTweet{
+			ID:       2,
+			Text:     "A long tweet that got trunc…",
+			FullText: "A long tweet that got truncated in the retweet",
+			User:     alice,
+		},
+	}
+	if html := buildTweet(&retweet); !strings.Contains(html, "A long tweet that got truncated in the retweet") {
+		t.Errorf("Output is missing the retweeted full text: %s", html)
+	}
+}
+
+func TestWindowKeys(t *testing.T) {
+	defineConfig()
+
+	tests := []struct {
+		now      string
+		n        int
+		expected string
+	}{
+		{"2020-03-03T14:00:00Z", 0, "tweets/2020-03-03-1/tweets.json"},
+		{"2020-03-03T14:00:00Z", 1, "tweets/2020-03-03-0/tweets.json"},
+		{"2020-03-03T23:59:59Z", 1, "tweets/2020-03-03-1/tweets.json"},
+		{"2020-03-03T00:00:00Z", 0, "tweets/2020-03-03-0/tweets.json"},
+		{"2020-03-03T00:30:00Z", 1, "tweets/2020-03-02-2/tweets.json"},
+		{"2020-03-03T00:30:00Z", 4, "tweets/2020-03-01-2/tweets.json"},
+		{"2020-03-01T07:59:59Z", 1, "tweets/2020-02-29-2/tweets.json"},
+		{"2021-03-01T07:59:59Z", 1, "tweets/2021-02-28-2/tweets.json"},
+		{"2020-01-01T00:00:00Z", 1, "tweets/2019-12-31-2/tweets.json"},
+		{"2020-01-01T05:00:00Z", 3, "tweets/2019-12-31-0/tweets.json"},
+	}
+
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := formatDate(&feed{}, windowStart(now, test.n)); key != test.expected {
+			t.Errorf("%d windows before %s: expected %s, got %s", test.n, test.now, test.expected, key)
+		}
+	}
+}
+
+func TestWindowKeysAtClock(t *testing.T) {
+	defineConfig()
+	saved := location
+	t.Cleanup(func() {
+		clock = time.Now
+		location = saved
+	})
+
+	tests := []struct {
+		zone     string
+		now      string
+		today    string
+		previous string
+		// previousHours is how long the previous window lasted
+		previousHours float64
+	}{
+		// Midnight and window edges
+		{"UTC", "2020-03-03T00:00:00Z", "2020-03-03-0", "2020-03-02-2", 8},
+		{"UTC", "2020-03-03T07:59:59.999Z", "2020-03-03-0", "2020-03-02-2", 8},
+		{"UTC", "2020-03-03T08:00:00Z", "2020-03-03-1", "2020-03-03-0", 8},
+		{"UTC", "2020-03-03T23:59:59Z", "2020-03-03-2", "2020-03-03-1", 8},
+		// Just before and after clocks spring forward at 02:00 EST
+		{"America/New_York", "2020-03-08T06:59:59Z", "2020-03-08-0", "2020-03-07-2", 8},
+		{"America/New_York", "2020-03-08T07:00:00Z", "2020-03-08-0", "2020-03-07-2", 8},
+		{"America/New_York", "2020-03-08T11:59:59Z", "2020-03-08-0", "2020-03-07-2", 8},
+		{"America/New_York", "2020-03-08T12:00:00Z", "2020-03-08-1", "2020-03-08-0", 7},
+		// 01:30 happens twice when clocks fall back at 02:00 EDT
+		{"America/New_York", "2020-11-01T05:30:00Z", "2020-11-01-0", "2020-10-31-2", 8},
+		{"America/New_York", "2020-11-01T06:30:00Z", "2020-11-01-0", "2020-10-31-2", 8},
+		{"America/New_York", "2020-11-01T13:00:00Z", "2020-11-01-1", "2020-11-01-0", 9},
+	}
+
+	for _, test := range tests {
+		var err error
+		location, err = time.LoadLocation(test.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now, err := time.Parse(time.RFC3339Nano, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock = func() time.Time { return now }
+
+		f := &feed{}
+		if key, expected := getTodaysKey(f), "tweets/"+test.today+"/tweets.json"; key != expected {
+			t.Errorf("current window at %s in %s: expected %s, got %s", test.now, test.zone, expected, key)
+		}
+		previous := previousWindow(f, 1)
+		if expected := "tweets/" + test.previous + "/tweets.json"; previous.key != expected {
+			t.Errorf("previous window at %s in %s: expected %s, got %s", test.now, test.zone, expected, previous.key)
+		}
+		if hours := previous.end.Sub(previous.start).Hours(); hours != test.previousHours {
+			t.Errorf("previous window at %s in %s lasted %v hours, expected %v", test.now, test.zone, hours, test.previousHours)
+		}
+	}
+}
+
+func TestBuildTweetTimestamp(t *testing.T) {
+	defineConfig()
+	var err error
+	location, err = time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tweet := DigestTweet{
+		ID:        1,
+		CreatedAt: "Tue Mar 03 14:05:00 +0000 2020",
+		User:      &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+	html := buildTweet(&tweet)
+	if !strings.Contains(html, `<a href="https://twitter.com/alice/status/1" style="color: rgb(136, 153, 166); text-decoration: none;">· Mar 3 09:05</a>`) {
+		t.Errorf("Output is missing the local posting time: %s", html)
+	}
+
+	tweet.CreatedAt = "yesterday"
+	html = buildTweet(&tweet)
+	if strings.Contains(html, "·") {
+		t.Errorf("Output has a timestamp for an unparseable creation time: %s", html)
+	}
+}
+
+func TestBuildTweetLineBreaks(t *testing.T) {
+	defineConfig()
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: "First paragraph\nsecond line\n\n\n\nSecond paragraph #tag\nafter the tag",
+		Entities: &TweetEntities{
+			Hashtags: []HashtagEntity{{Indices: Indices{48, 52}, Text: "tag"}},
+		},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+
+	html := buildTweet(&tweet)
+	for _, expected := range []string{
+		"First paragraph<br>second line<br><br>Second paragraph ",
+		`#tag</a><a href="https://twitter.com/alice/status/1" style="color: black; text-decoration: none;"><br>after the tag`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Output is missing %q: %s", expected, html)
+		}
+	}
+	if strings.Contains(html, "<br><br><br>") {
+		t.Errorf("Output keeps a run of more than two line breaks: %s", html)
+	}
+}
+
+func TestDedupTweets(t *testing.T) {
+	newTweets := []DigestTweet{{ID: 4, FullText: "new"}, {ID: 3, FullText: "edited"}}
+	storedTweets := []DigestTweet{{ID: 3, FullText: "original"}, {ID: 2}, {ID: 2}, {ID: 1}}
+
+	tweets := dedupTweets(append(newTweets, storedTweets...))
+	var ids []int64
+	for _, tweet := range tweets {
+		ids = append(ids, tweet.ID)
+	}
+	if len(ids) != 4 || ids[0] != 4 || ids[1] != 3 || ids[2] != 2 || ids[3] != 1 {
+		t.Fatalf("Deduplicated IDs are %v, want [4 3 2 1]", ids)
+	}
+	if tweets[1].FullText != "edited" {
+		t.Errorf("Kept %q of tweet 3, want the newest version", tweets[1].FullText)
+	}
+}
+
+func TestGroupThreads(t *testing.T) {
+	tweets := []DigestTweet{
+		{ID: 1},
+		{ID: 2, InReplyToStatusID: 100},
+		{ID: 3, InReplyToStatusID: 1},
+		{ID: 4, QuotedStatusID: 1},
+		{ID: 5, InReplyToStatusID: 3},
+	}
+
+	threads := groupThreads(tweets)
+	if len(threads) != 2 || threads[0].tweet.ID != 1 || threads[1].tweet.ID != 2 {
+		t.Fatalf("Expected threads starting at tweets 1 and 2, got %d threads", len(threads))
+	}
+	replies := threads[0].replies
+	if len(replies) != 2 || replies[0].tweet.ID != 3 || replies[1].tweet.ID != 4 {
+		t.Fatalf("Expected tweets 3 and 4 under tweet 1, got %d replies", len(replies))
+	}
+	if len(replies[0].replies) != 1 || replies[0].replies[0].tweet.ID != 5 {
+		t.Errorf("Expected tweet 5 under tweet 3")
+	}
+	if len(threads[1].replies) != 0 {
+		t.Errorf("Expected no replies under tweet 2")
+	}
+}
+
+func TestBuildDigestSortsOldestFirst(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	var tweets []DigestTweet
+	for _, id := range []int64{20, 30, 10, 50, 40} {
+		tweets = append(tweets, DigestTweet{ID: id, User: &TweetUser{ScreenName: "alice"}})
+	}
+
+	htmlBody, textBody := buildDigest(tweets)
+	for _, body := range []string{htmlBody, textBody} {
+		last := -1
+		for _, id := range []string{"10", "20", "30", "40", "50"} {
+			i := strings.Index(body, "https://twitter.com/alice/status/"+id)
+			if i < last {
+				t.Errorf("Tweet %s isn’t after the older ones: %s", id, body)
+			}
+			last = i
+		}
+	}
+	if tweets[0].ID != 20 {
+		t.Errorf("buildDigest reordered the tweets passed to it")
+	}
+}
+
+func TestTweetTextStripsMediaLink(t *testing.T) {
+	defineConfig()
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: "Look at https://t.co/link and my cat https://t.co/cat",
+		Entities: &TweetEntities{
+			Urls: []URLEntity{{
+				Indices:     Indices{8, 25},
+				URL:         "https://t.co/link",
+				DisplayURL:  "example.com/link",
+				ExpandedURL: "https://example.com/link",
+			}},
+			Media: []MediaEntity{{URLEntity: URLEntity{
+				Indices: Indices{37, 53},
+				URL:     "https://t.co/cat",
+			}}},
+		},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+
+	text := tweetText(&tweet, "https://twitter.com/alice/status/1")
+	if strings.Contains(text, "t.co/cat") {
+		t.Errorf("HTML text keeps the media link: %s", text)
+	}
+	if !strings.Contains(text, " and my cat</a>") {
+		t.Errorf("HTML text doesn’t end cleanly before the media link: %s", text)
+	}
+	if !strings.Contains(text, `<a href="https://example.com/link"`) {
+		t.Errorf("HTML text lost the outbound link: %s", text)
+	}
+
+	if plain := tweetPlainText(&tweet); plain != "Look at https://example.com/link and my cat" {
+		t.Errorf("Plain text is %q", plain)
+	}
+}
+
+func TestTweetTextEmojiBeforeLink(t *testing.T) {
+	defineConfig()
+	// Indices count code points: each emoji is one, though it is four bytes
+	// and two UTF-16 code units
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: "🎉🎉 Party at https://t.co/party 🥳 https://t.co/pic",
+		Entities: &TweetEntities{
+			Urls: []URLEntity{{
+				Indices:     Indices{12, 30},
+				URL:         "https://t.co/party",
+				DisplayURL:  "example.com/party",
+				ExpandedURL: "https://example.com/party",
+			}},
+			Media: []MediaEntity{{URLEntity: URLEntity{Indices: Indices{33, 49}, URL: "https://t.co/pic"}}},
+		},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+
+	text := tweetText(&tweet, "https://twitter.com/alice/status/1")
+	if !strings.Contains(text, `>🎉🎉 Party at </a><a href="https://example.com/party" style="color: rgb(27, 149, 224); text-decoration: none;">example.com/party</a>`) {
+		t.Errorf("HTML text doesn’t link the right characters: %s", text)
+	}
+	if !strings.HasSuffix(text, "> 🥳</a>") || strings.Contains(text, "t.co") {
+		t.Errorf("HTML text doesn’t strip the media link cleanly: %s", text)
+	}
+	if plain := tweetPlainText(&tweet); plain != "🎉🎉 Party at https://example.com/party 🥳" {
+		t.Errorf("Plain text is %q", plain)
+	}
+}
+
+func TestTweetTextDisplayTextRange(t *testing.T) {
+	defineConfig()
+	// Indices count characters, and the emoji takes four bytes
+	tweet := DigestTweet{
+		ID:               1,
+		FullText:         "@bob @carol @dave @erin @frank Ça marche 🎉 #yes https://t.co/pic",
+		DisplayTextRange: &Indices{31, 47},
+		Entities: &TweetEntities{
+			Hashtags: []HashtagEntity{{Indices: Indices{43, 47}, Text: "yes"}},
+			Media:    []MediaEntity{{URLEntity: URLEntity{Indices: Indices{48, 64}, URL: "https://t.co/pic"}}},
+		},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+	for _, screenName := range []string{"bob", "carol", "dave", "erin", "frank"} {
+		start := strings.Index(tweet.FullText, "@"+screenName)
+		start = len([]rune(tweet.FullText[:start]))
+		tweet.Entities.UserMentions = append(tweet.Entities.UserMentions, MentionEntity{
+			Indices:    Indices{start, start + 1 + len(screenName)},
+			ScreenName: screenName,
+		})
+	}
+
+	text := tweetText(&tweet, "https://twitter.com/alice/status/1")
+	if strings.Contains(text, "@") || !strings.Contains(text, ">Ça marche 🎉 </a>") {
+		t.Errorf("HTML text doesn’t start after the mentions: %s", text)
+	}
+	if !strings.Contains(text, `<a href="https://twitter.com/hashtag/yes"`) {
+		t.Errorf("HTML text lost the hashtag: %s", text)
+	}
+	if plain := tweetPlainText(&tweet); plain != "Ça marche 🎉 #yes" {
+		t.Errorf("Plain text is %q", plain)
+	}
+
+	*show_reply_mentions = true
+	text = tweetText(&tweet, "https://twitter.com/alice/status/1")
+	for _, screenName := range []string{"bob", "carol", "dave", "erin", "frank"} {
+		if !strings.Contains(text, `<a href="https://twitter.com/`+screenName+`"`) {
+			t.Errorf("HTML text doesn’t link the mention of @%s: %s", screenName, text)
+		}
+	}
+	if plain := tweetPlainText(&tweet); plain != "@bob @carol @dave @erin @frank Ça marche 🎉 #yes" {
+		t.Errorf("Plain text with the mentions is %q", plain)
+	}
+}
+
+func TestBuildHeader(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	w := window{
+		start: time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC),
+		end:   time.Date(2020, 3, 3, 16, 0, 0, 0, time.UTC),
+	}
+
+	tweets := []DigestTweet{
+		{ID: 2, CreatedAt: "Tue Mar 03 09:30:00 +0000 2020"},
+		{ID: 1, CreatedAt: "Tue Mar 03 07:00:00 +0000 2020"},
+	}
+	_, text := buildHeader(digestSpan(w, tweets))
+	if text != "2 tweets posted Mar 3 07:00–Mar 3 09:30.\n\n" {
+		t.Errorf("Header is %q", text)
+	}
+
+	tweets = tweets[1:]
+	_, text = buildHeader(digestSpan(w, tweets))
+	if !strings.HasPrefix(text, "No tweets were posted in the window Mar 3 08:00–Mar 3 16:00. Catching up on 1 tweets") {
+		t.Errorf("Header doesn’t say the digest is catching up: %q", text)
+	}
+}
+
+func TestCardTemplateFile(t *testing.T) {
+	defineConfig()
+	path := t.TempDir() + "/card.html"
+	if err := os.WriteFile(path, []byte(`<p>{{.Name}} {{.Text}}</p>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadCardTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous *htmltemplate.Template) { cardTemplate = previous }(cardTemplate)
+	cardTemplate = tmpl
+
+	tweet := DigestTweet{ID: 1, FullText: "hi", User: &TweetUser{Name: "<b>Mallory</b>", ScreenName: "mallory"}}
+	expected := `<p>&lt;b&gt;Mallory&lt;/b&gt; <a href="https://twitter.com/mallory/status/1" style="color: black; text-decoration: none;">hi</a></p>`
+	if html := buildTweet(&tweet); html != expected {
+		t.Errorf("Custom template rendered %s, want %s", html, expected)
+	}
+}
+
+func TestCollapseRetweets(t *testing.T) {
+	viral := &DigestTweet{ID: 1, FullText: "viral", User: &TweetUser{Name: "Carol", ScreenName: "carol"}}
+	tweets := []DigestTweet{
+		{ID: 14, RetweetedStatus: viral, User: &TweetUser{Name: "Dan", ScreenName: "dan"}},
+		{ID: 13, FullText: "own tweet", User: &TweetUser{Name: "Alice", ScreenName: "alice"}},
+		{ID: 12, RetweetedStatus: viral, User: &TweetUser{Name: "Bob", ScreenName: "bob"}},
+		{ID: 11, RetweetedStatus: viral, User: &TweetUser{Name: "Alice", ScreenName: "alice"}},
+	}
+
+	collapsed := collapseRetweets(tweets)
+	if len(collapsed) != 2 || collapsed[0].ID != 13 || collapsed[1].ID != 11 {
+		t.Fatalf("Expected tweets 13 and 11, got %+v", collapsed)
+	}
+	if name := collapsed[1].User.Name; name != "Alice, Bob, and Dan" {
+		t.Errorf("Retweet is credited to %q", name)
+	}
+	if tweets[3].User.Name != "Alice" {
+		t.Errorf("collapseRetweets renamed the original retweeter")
+	}
+}
+
+func TestDropQuotedTweets(t *testing.T) {
+	alice := &TweetUser{Name: "Alice", ScreenName: "alice"}
+	quote := func(id int64, quoted DigestTweet) DigestTweet {
+		return DigestTweet{ID: id, User: alice, QuotedStatusID: quoted.ID, QuotedStatus: &quoted}
+	}
+	one := DigestTweet{ID: 1, FullText: "quoted", User: alice}
+	two := DigestTweet{ID: 2, FullText: "quoted while unavailable", User: alice}
+	six := DigestTweet{ID: 6, FullText: "quoted by a dropped tweet", User: alice}
+	seven := quote(7, six)
+	tweets := []DigestTweet{
+		one,
+		two,
+		quote(3, one),
+		quote(5, DigestTweet{ID: 2}),
+		six,
+		seven,
+		{ID: 8, User: alice, RetweetedStatus: &DigestTweet{ID: 4, User: alice, QuotedStatusID: 7, QuotedStatus: &seven}},
+	}
+
+	var ids []int64
+	for _, tweet := range dropQuotedTweets(tweets) {
+		ids = append(ids, tweet.ID)
+	}
+	if !reflect.DeepEqual(ids, []int64{2, 3, 5, 6, 8}) {
+		t.Errorf("Kept tweets %v, want [2 3 5 6 8]", ids)
+	}
+}
+
+func TestBuildAtom(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	tweets := []DigestTweet{
+		{ID: 1, CreatedAt: "Tue Mar 03 09:30:00 +0000 2020", FullText: "older", User: &TweetUser{Name: "Alice", ScreenName: "alice"}},
+		{ID: 2, CreatedAt: "Tue Mar 03 10:30:00 +0000 2020", FullText: "newer <3", User: &TweetUser{Name: "Bob", ScreenName: "bob"}},
+	}
+	data, err := buildAtom(&feed{Name: "news", ListID: 1234}, tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atom := string(data)
+	for _, expected := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom">`,
+		`<title>Twitter digest: news</title>`,
+		`<id>https://twitter.com/i/lists/1234</id>`,
+		`<title>Bob (@bob): newer &lt;3</title>`,
+		`<updated>2020-03-03T10:30:00Z</updated>`,
+		`<link href="https://twitter.com/alice/status/1"></link>`,
+		`<content type="html">`,
+		`newer &amp;lt;3`,
+	} {
+		if !strings.Contains(atom, expected) {
+			t.Errorf("Feed is missing %q: %s", expected, atom)
+		}
+	}
+	if strings.Index(atom, "status/2") > strings.Index(atom, "status/1") {
+		t.Errorf("Entries aren’t newest first: %s", atom)
+	}
+}
+
+func TestBuildMediaVideo(t *testing.T) {
+	defineConfig()
+	tweet := DigestTweet{
+		ID:   1,
+		User: &TweetUser{ScreenName: "alice"},
+		ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{
+			{Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/photo.jpg"},
+			{Type: "video", MediaURLHttps: "https://pbs.twimg.com/ext_tw_video_thumb/video.jpg", VideoInfo: VideoInfo{DurationMillis: 83500}},
+			{Type: "animated_gif", MediaURLHttps: "https://pbs.twimg.com/tweet_video_thumb/gif.jpg"},
+		}},
+	}
+
+	media := buildMedia(&tweet)
+	for _, expected := range []string{
+		`<img src="https://pbs.twimg.com/media/photo.jpg"`,
+		`<a href="https://twitter.com/alice/status/1" style="display: block;`,
+		`<img src="https://pbs.twimg.com/ext_tw_video_thumb/video.jpg"`,
+		`>1:23</span>`,
+		`<img src="https://pbs.twimg.com/tweet_video_thumb/gif.jpg"`,
+		`>GIF</span>`,
+	} {
+		if !strings.Contains(media, expected) {
+			t.Errorf("Media is missing %q: %s", expected, media)
+		}
+	}
+	if photos := tweetPhotos(&tweet); len(photos) != 1 {
+		t.Errorf("Videos are counted as photos: %v", photos)
+	}
+}
+
+func TestProfileImageURL(t *testing.T) {
+	tests := []struct {
+		avatar, size, want string
+	}{
+		{"https://pbs.twimg.com/profile_images/1/alice_normal.jpg", "reasonably_small", "https://pbs.twimg.com/profile_images/1/alice_reasonably_small.jpg"},
+		{"https://pbs.twimg.com/profile_images/1/alice_bigger.png", "normal", "https://pbs.twimg.com/profile_images/1/alice_normal.png"},
+		{"https://pbs.twimg.com/profile_images/1/alice_normal.jpg", "", "https://pbs.twimg.com/profile_images/1/alice.jpg"},
+		{"https://pbs.twimg.com/profile_images/1/alice_normal", "400x400", "https://pbs.twimg.com/profile_images/1/alice_400x400"},
+		// A size before a query string
+		{"https://pbs.twimg.com/profile_images/1/alice_normal.jpg?v=2", "reasonably_small", "https://pbs.twimg.com/profile_images/1/alice_reasonably_small.jpg?v=2"},
+		// The default egg doesn’t come in every size
+		{"https://abs.twimg.com/sticky/default_profile_images/default_profile_normal.png", "reasonably_small", "https://abs.twimg.com/sticky/default_profile_images/default_profile_normal.png"},
+		// No size to replace
+		{"https://example.com/avatar.jpg", "reasonably_small", "https://example.com/avatar.jpg"},
+		{"", "reasonably_small", ""},
+	}
+	for _, test := range tests {
+		got := profileImageURL(&TweetUser{ProfileImageURLHttps: test.avatar}, test.size)
+		if got != test.want {
+			t.Errorf("profileImageURL(%q, %q) = %q, want %q", test.avatar, test.size, got, test.want)
+		}
+	}
+}
+
+func TestParseCatchUp(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	start, end, err := parseCatchUp("2020-03-03 08:00", "2020-03-04T00:00:00+01:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("start = %s, want %s", start, want)
+	}
+	if want := time.Date(2020, 3, 3, 23, 0, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("end = %s, want %s", end, want)
+	}
+
+	var keys []string
+	for date := start; date.Before(end); {
+		w := windowAt(&feed{}, date)
+		keys = append(keys, w.key)
+		date = w.end
+	}
+	if want := []string{"tweets/2020-03-03-1/tweets.json", "tweets/2020-03-03-2/tweets.json"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("windows = %v, want %v", keys, want)
+	}
+
+	for _, test := range [][2]string{{"", ""}, {"yesterday", ""}, {"2020-03-03 08:00", "2020-03-03 08:00"}} {
+		if _, _, err := parseCatchUp(test[0], test[1]); err == nil {
+			t.Errorf("parseCatchUp(%q, %q) succeeded", test[0], test[1])
+		}
+	}
+}
+
+func TestSnowflakeID(t *testing.T) {
+	posted := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	id := snowflakeID(posted)
+	if got := time.Unix(0, ((id>>22)+twitterEpoch)*int64(time.Millisecond)); !got.Equal(posted) {
+		t.Errorf("tweet ID %d was posted at %s, want %s", id, got, posted)
+	}
+	if snowflakeID(posted.Add(time.Millisecond)) <= id {
+		t.Error("tweet IDs don't grow with time")
+	}
+}
+
+func TestTwitterClientCached(t *testing.T) {
+	defineConfig()
+	*bearer_token = "first"
+
+	first, _ := twitterClient()
+	if again, _ := twitterClient(); again != first {
+		t.Error("twitterClient built a new client for the same credentials")
+	}
+
+	*bearer_token = "second"
+	if changed, _ := twitterClient(); changed == first {
+		t.Error("twitterClient reused the client after the credentials changed")
+	}
+}
+
+func TestTwitterClientUserAgent(t *testing.T) {
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("Authorization = %q, want the bearer token", auth)
+		}
+	}))
+	defer srv.Close()
+
+	defineConfig()
+	*bearer_token = "token"
+	for _, agent := range []string{"", "digest-bot/1.0"} {
+		*user_agent = agent
+		httpClient, _ := twitterClient()
+		resp, err := httpClient.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(agents) != 2 || agents[0] == "digest-bot/1.0" || agents[1] != "digest-bot/1.0" {
+		t.Errorf("requests were sent with user agents %q, want the default one then digest-bot/1.0", agents)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	defineConfig()
+	defer func() { *key_prefix = "tweets/" }()
+	date := time.Date(2020, 3, 3, 14, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		prefix string
+		f      *feed
+		key    string
+	}{
+		{"tweets/", &feed{}, "tweets/2020-03-03-1/tweets.json"},
+		{"/staging/tweets", &feed{}, "staging/tweets/2020-03-03-1/tweets.json"},
+		{"staging//", &feed{Name: "news"}, "staging/news/2020-03-03-1/tweets.json"},
+		{"/", &feed{ListID: 1234}, "list-1234/2020-03-03-1/tweets.json"},
+	}
+	for _, test := range tests {
+		*key_prefix = normalizeKeyPrefix(test.prefix)
+		if key := formatDate(test.f, date); key != test.key {
+			t.Errorf("key with prefix %q is %s, want %s", test.prefix, key, test.key)
+		}
+		if since := sinceIDKey(test.f); !strings.HasPrefix(test.key, strings.TrimSuffix(since, "since_id")) {
+			t.Errorf("since_id key with prefix %q is %s, not next to %s", test.prefix, since, test.key)
+		}
+	}
+}
+
+func TestLocaleMessages(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	msgs = locales["de"]
+	defer func() { msgs = locales["en"] }()
+
+	retweet := DigestTweet{
+		ID:   2,
+		User: &TweetUser{Name: "Bob", ScreenName: "bob"},
+		RetweetedStatus: &DigestTweet{
+			ID:        1,
+			CreatedAt: "Tue Mar 03 14:05:00 +0000 2020",
+			FullText:  "Hello",
+			User:      &TweetUser{Name: "Alice", ScreenName: "alice"},
+		},
+	}
+	if html := buildTweet(&retweet); !strings.Contains(html, "Bob hat retweetet") || !strings.Contains(html, "3.3. 14:05") {
+		t.Errorf("Card isn't in German: %s", html)
+	}
+
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	data := digestData{Count: 2, Start: start, End: start.Add(time.Hour), InWindow: 2}
+	if _, text := buildHeader(data); text != "2 Tweets vom 3.3. 08:00 bis 3.3. 09:00.\n\n" {
+		t.Errorf("Header is %q", text)
+	}
+	if subject, err := buildSubject(&feed{}, data); err != nil || subject != "2 Tweets · 3.3. 08:00–09:00" {
+		t.Errorf("Subject is %q, %v", subject, err)
+	}
+}
+
+// stubTwitter serves the Twitter API calls made during a test with handler
+func stubTwitter(t *testing.T, handler http.HandlerFunc) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, err := neturl.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpClient := &http.Client{Transport: rewriteTransport{target: target}}
+	twitterClients.Lock()
+	twitterClients.key = twitterClientKey()
+	twitterClients.http = httpClient
+	twitterClients.client = twitter.NewClient(httpClient)
+	twitterClients.Unlock()
+	t.Cleanup(func() {
+		twitterClients.Lock()
+		twitterClients.http = nil
+		twitterClients.Unlock()
+	})
+}
+
+// rewriteTransport sends requests to target instead of their own host
+type rewriteTransport struct {
+	target *neturl.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFetchFeedEmailsPreviousWindow(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	outputs = map[string]bool{"email": true}
+	*dry_run = true
+	*dry_run_file = filepath.Join(t.TempDir(), "email.html")
+	tweetStore = fsStore{dir: t.TempDir()}
+	ctx := context.Background()
+	f := &feed{}
+
+	// The current window wasn’t stored yet, the previous one was stored before
+	// since_id was tracked on its own
+	previous := previousWindow(f, 1)
+	stored := []DigestTweet{
+		{ID: 5, FullText: "previous five", User: &TweetUser{Name: "Alice", ScreenName: "alice"}},
+		{ID: 4, FullText: "previous four", User: &TweetUser{Name: "Alice", ScreenName: "alice"}},
+	}
+	if err := tweetStore.Put(ctx, previous.key, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	stubTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		if since := r.URL.Query().Get("since_id"); since != "5" {
+			t.Errorf("home timeline requested since_id %q, want 5", since)
+		}
+		json.NewEncoder(w).Encode([]twitter.Tweet{{ID: 6, FullText: "new six", User: &twitter.User{Name: "Bob", ScreenName: "bob"}}})
+	})
+
+	var result FeedResult
+	if err := fetchFeed(ctx, f, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Emailed || result.NewTweetCount != 1 || result.SinceID != 6 {
+		t.Errorf("result is %+v", result)
+	}
+
+	email, err := os.ReadFile(*dry_run_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"previous five", "previous four"} {
+		if !strings.Contains(string(email), text) {
+			t.Errorf("email is missing %q: %s", text, email)
+		}
+	}
+	if strings.Contains(string(email), "new six") {
+		t.Errorf("email has a tweet of the current window: %s", email)
+	}
+
+	if emailed, err := tweetStore.GetTweetID(ctx, emailedKey(previous.key)); err != nil || emailed != 5 {
+		t.Errorf("emailed marker is %d, %v, want 5", emailed, err)
+	}
+	if sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(f)); err != nil || sinceID != 6 {
+		t.Errorf("since_id is %d, %v, want 6", sinceID, err)
+	}
+	current, err := tweetStore.Get(ctx, getTodaysKey(f))
+	if err != nil || len(current) != 1 || current[0].ID != 6 {
+		t.Errorf("current window holds %+v, %v, want tweet 6", current, err)
+	}
+}
+
+// failingStore is an fsStore whose Get fails with err
+type failingStore struct {
+	fsStore
+	err error
+}
+
+func (s failingStore) Get(ctx context.Context, key string) ([]DigestTweet, error) {
+	return nil, s.err
+}
+
+func TestFetchFeedReturnsStoreErrors(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	injected := errors.New("connection reset by peer")
+	tweetStore = failingStore{fsStore: fsStore{dir: t.TempDir()}, err: injected}
+	stubTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Twitter was called after the store failed: %s", r.URL)
+	})
+
+	var result FeedResult
+	if err := fetchFeed(context.Background(), &feed{}, &result); err != injected {
+		t.Errorf("fetchFeed returned %v, want %v", err, injected)
+	}
+}
+
+func TestRetryTwitter(t *testing.T) {
+	defineConfig()
+	*twitter_retries = 2
+	*twitter_max_backoff = time.Millisecond
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		status   int
+		reset    string
+		failures int
+		calls    int
+		succeeds bool
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, reset: reset, failures: 2, calls: 3, succeeds: true},
+		{name: "rate limited without reset", status: http.StatusTooManyRequests, failures: 1, calls: 2, succeeds: true},
+		{name: "server error", status: http.StatusServiceUnavailable, failures: 2, calls: 3, succeeds: true},
+		{name: "out of retries", status: http.StatusInternalServerError, failures: 5, calls: 3},
+		{name: "unauthorized", status: http.StatusUnauthorized, failures: 5, calls: 1},
+		{name: "not found", status: http.StatusNotFound, failures: 5, calls: 1},
+		{name: "no response", failures: 5, calls: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := retryTwitter(context.Background(), func() (*http.Response, error) {
+				calls++
+				if calls > test.failures {
+					return &http.Response{StatusCode: http.StatusOK}, nil
+				}
+				if test.status == 0 {
+					return nil, errors.New("connection refused")
+				}
+				resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+				if test.reset != "" {
+					resp.Header.Set("x-rate-limit-reset", test.reset)
+				}
+				return resp, errors.New(http.StatusText(test.status))
+			})
+			if calls != test.calls {
+				t.Errorf("made %d calls, want %d", calls, test.calls)
+			}
+			if (err == nil) != test.succeeds {
+				t.Errorf("error is %v", err)
+			}
+		})
+	}
+}
+
+func TestRetryTwitterStopsWithContext(t *testing.T) {
+	defineConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := retryTwitter(ctx, func() (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable}, errors.New("unavailable")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("made %d calls returning %v, want 1 call and its error", calls, err)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	defineConfig()
+	*twitter_max_backoff = 30 * time.Second
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		reset    string
+		min, max time.Duration
+	}{
+		{"reset ahead", strconv.FormatInt(now.Add(10*time.Second).Unix(), 10), 8 * time.Second, 10 * time.Second},
+		{"reset passed", strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), time.Second, time.Second},
+		{"no reset", "", 30 * time.Second, 30 * time.Second},
+		{"invalid reset", "soon", 30 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+		if test.reset != "" {
+			resp.Header.Set("x-rate-limit-reset", test.reset)
+		}
+		if wait := rateLimitWait(resp); wait < test.min || wait > test.max {
+			t.Errorf("%s: waits %s, want between %s and %s", test.name, wait, test.min, test.max)
+		}
+	}
+}
+
+func TestWalkTimeline(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		timeline        []int64
+		sinceID, maxID  int64
+		maxPages        int
+		wantIDs, maxIDs []int64
+	}{
+		{
+			name:     "stops at since_id",
+			timeline: []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			sinceID:  3,
+			maxPages: 10,
+			wantIDs:  []int64{10, 9, 8, 7, 6, 5, 4},
+			maxIDs:   []int64{0, 7, 4},
+		},
+		{
+			name:     "stops at an empty page",
+			timeline: []int64{5, 4, 3, 2},
+			maxPages: 10,
+			wantIDs:  []int64{5, 4, 3, 2},
+			maxIDs:   []int64{0, 2, 1},
+		},
+		{
+			name:     "stops at max-pages",
+			timeline: []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			maxPages: 2,
+			wantIDs:  []int64{10, 9, 8, 7, 6, 5},
+			maxIDs:   []int64{0, 7},
+		},
+		{
+			name:     "starts at max_id",
+			timeline: []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+			sinceID:  4,
+			maxID:    8,
+			maxPages: 10,
+			wantIDs:  []int64{8, 7, 6, 5},
+			maxIDs:   []int64{8, 5},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defineConfig()
+			*max_pages = test.maxPages
+			source := &fakeSource{}
+			for _, id := range test.timeline {
+				source.timeline = append(source.timeline, fakeTweet(id, "tweet"))
+			}
+
+			tweets, err := walkTimeline(context.Background(), test.sinceID, test.maxID, source.page(test.sinceID, 3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, tweet := range tweets {
+				ids = append(ids, tweet.ID)
+			}
+			if !reflect.DeepEqual(ids, test.wantIDs) {
+				t.Errorf("got tweets %v, want %v", ids, test.wantIDs)
+			}
+			if !reflect.DeepEqual(source.maxIDs, test.maxIDs) {
+				t.Errorf("requested max_ids %v, want %v", source.maxIDs, test.maxIDs)
+			}
+		})
+	}
+}
+
+func TestWalkTimelineSkipsOverlap(t *testing.T) {
+	defineConfig()
+	// Each page repeats the last tweet of the one before
+	pages := [][]DigestTweet{
+		{fakeTweet(4, "four"), fakeTweet(3, "three")},
+		{fakeTweet(3, "three"), fakeTweet(2, "two")},
+	}
+	var maxIDs []int64
+	getPage := func(maxID int64) ([]DigestTweet, *http.Response, error) {
+		maxIDs = append(maxIDs, maxID)
+		if len(maxIDs) > len(pages) {
+			return nil, &http.Response{StatusCode: http.StatusOK}, nil
+		}
+		return pages[len(maxIDs)-1], &http.Response{StatusCode: http.StatusOK}, nil
+	}
+
+	tweets, err := walkTimeline(context.Background(), 0, 0, getPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tweets) != 3 || tweets[0].ID != 4 || tweets[1].ID != 3 || tweets[2].ID != 2 {
+		t.Errorf("got tweets %v, want 4, 3 and 2 once each", tweets)
+	}
+	if !reflect.DeepEqual(maxIDs, []int64{0, 2, 1}) {
+		t.Errorf("requested max_ids %v, want [0 2 1]", maxIDs)
+	}
+}
+
+// fakeSource is a TweetSource serving a timeline from memory. It records the
+// since_id of each fetch.
+type fakeSource struct {
+	timeline []DigestTweet
+	sinceIDs []int64
+	maxIDs   []int64
+}
+
+func (s *fakeSource) GetTweets(ctx context.Context, f *feed, sinceID, maxID int64) ([]DigestTweet, error) {
+	s.sinceIDs = append(s.sinceIDs, sinceID)
+	var tweets []DigestTweet
+	for _, tweet := range s.timeline {
+		if tweet.ID > sinceID && (maxID == 0 || tweet.ID <= maxID) {
+			tweets = append(tweets, tweet)
+		}
+	}
+	return tweets, nil
+}
+
+// page serves timeline a page of size tweets at a time like the Twitter API
+// does, recording the maxIDs requested
+func (s *fakeSource) page(sinceID int64, size int) func(maxID int64) ([]DigestTweet, *http.Response, error) {
+	return func(maxID int64) ([]DigestTweet, *http.Response, error) {
+		s.maxIDs = append(s.maxIDs, maxID)
+		tweets, _ := s.GetTweets(context.Background(), nil, sinceID, maxID)
+		if len(tweets) > size {
+			tweets = tweets[:size]
+		}
+		return tweets, &http.Response{StatusCode: http.StatusOK}, nil
+	}
+}
+
+// fakeMailer is a Mailer keeping the plain-text bodies of the emails it
+// sends, and their HTML bodies
+type fakeMailer struct {
+	sent []string
+	html []string
+	// failures are how many sends fail before they succeed
+	failures int
+}
+
+func (m *fakeMailer) Send(subject, htmlBody, textBody string) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("message rejected")
+	}
+	m.sent = append(m.sent, textBody)
+	m.html = append(m.html, htmlBody)
+	return nil
+}
+
+// fakeRun configures a run of the default feed against fakes, with tweets
+// kept in a temporary directory
+func fakeRun(t *testing.T) (*fakeSource, *fakeMailer) {
+	defineConfig()
+	*metrics_namespace = ""
+	location = time.UTC
+	outputs = map[string]bool{"email": true}
+	feeds = []*feed{{}}
+	tweetStore = fsStore{dir: t.TempDir()}
+
+	source, m := &fakeSource{}, &fakeMailer{}
+	tweetSource = source
+	mailerFor = func(context.Context, *feed) (Mailer, error) { return m, nil }
+	t.Cleanup(func() {
+		tweetSource = twitterAPI{}
+		mailerFor = newMailer
+	})
+	return source, m
+}
+
+func fakeTweet(id int64, text string) DigestTweet {
+	return DigestTweet{ID: id, FullText: text, User: &TweetUser{Name: "Alice", ScreenName: "alice"}}
+}
+
+// storedIDs returns the IDs of the tweets stored at key
+func storedIDs(t *testing.T, key string) []int64 {
+	t.Helper()
+	tweets, err := tweetStore.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("getting %s: %v", key, err)
+	}
+	var ids []int64
+	for _, tweet := range tweets {
+		ids = append(ids, tweet.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestFetchTweetsFirstRun(t *testing.T) {
+	source, m := fakeRun(t)
+	source.timeline = []DigestTweet{fakeTweet(2, "two"), fakeTweet(1, "one")}
+	ctx := context.Background()
+
+	result, err := fetchTweets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NewTweetCount != 2 || result.Emailed {
+		t.Errorf("result is %+v", result)
+	}
+	if !reflect.DeepEqual(source.sinceIDs, []int64{0}) {
+		t.Errorf("fetched with since_ids %v, want [0]", source.sinceIDs)
+	}
+	if len(m.sent) != 0 {
+		t.Errorf("first run sent %d emails", len(m.sent))
+	}
+	if ids := storedIDs(t, getTodaysKey(feeds[0])); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("current window holds %v, want [1 2]", ids)
+	}
+	if sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(feeds[0])); err != nil || sinceID != 2 {
+		t.Errorf("since_id is %d, %v, want 2", sinceID, err)
+	}
+}
+
+func TestFetchTweetsContinuesWindow(t *testing.T) {
+	source, m := fakeRun(t)
+	ctx := context.Background()
+	today := getTodaysKey(feeds[0])
+	if err := tweetStore.Put(ctx, today, []DigestTweet{fakeTweet(1, "one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 1); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = []DigestTweet{fakeTweet(3, "three"), fakeTweet(2, "two"), fakeTweet(1, "one")}
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(source.sinceIDs, []int64{1}) {
+		t.Errorf("fetched with since_ids %v, want [1]", source.sinceIDs)
+	}
+	if len(m.sent) != 0 {
+		t.Errorf("continuing a window sent %d emails", len(m.sent))
+	}
+	if ids := storedIDs(t, today); !reflect.DeepEqual(ids, []int64{1, 2, 3}) {
+		t.Errorf("current window holds %v, want [1 2 3]", ids)
+	}
+}
+
+func TestFetchTweetsEmailsPreviousWindowOnce(t *testing.T) {
+	source, m := fakeRun(t)
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	if err := tweetStore.Put(ctx, previous.key, []DigestTweet{fakeTweet(1, "previous one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 1); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = []DigestTweet{fakeTweet(2, "current two")}
+
+	for run := 0; run < 2; run++ {
+		if _, err := fetchTweets(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(m.sent))
+	}
+	if !strings.Contains(m.sent[0], "previous one") || strings.Contains(m.sent[0], "current two") {
+		t.Errorf("email doesn’t hold just the previous window: %s", m.sent[0])
+	}
+	if ids := storedIDs(t, getTodaysKey(feeds[0])); !reflect.DeepEqual(ids, []int64{2}) {
+		t.Errorf("current window holds %v, want [2]", ids)
+	}
+}
+
+func TestDryRunFileKeepsEveryPart(t *testing.T) {
+	source, _ := fakeRun(t)
+	mailerFor = newMailer
+	*dry_run = true
+	*dry_run_file = filepath.Join(t.TempDir(), "email.html")
+	*max_tweets_per_email = 2
+	if err := os.WriteFile(*dry_run_file, []byte("an earlier run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	stored := []DigestTweet{fakeTweet(3, "previous three"), fakeTweet(2, "previous two"), fakeTweet(1, "previous one")}
+	if err := tweetStore.Put(ctx, previous.key, stored); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = stored
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	email, err := os.ReadFile(*dry_run_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"(1/2) -->", "(2/2) -->", "previous one", "previous two", "previous three"} {
+		if !strings.Contains(string(email), text) {
+			t.Errorf("dry-run file is missing %q: %s", text, email)
+		}
+	}
+	if strings.Contains(string(email), "an earlier run") {
+		t.Errorf("dry-run file kept an earlier run: %s", email)
+	}
+}
+
+// failingObjectStore is an fsStore whose PutObject fails
+type failingObjectStore struct {
+	fsStore
+}
+
+func (s failingObjectStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	return errors.New("access denied")
+}
+
+func TestFetchTweetsOutputFailingAfterEmail(t *testing.T) {
+	source, m := fakeRun(t)
+	outputs = map[string]bool{"email": true, "rss": true}
+	tweetStore = failingObjectStore{fsStore: tweetStore.(fsStore)}
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	if err := tweetStore.Put(ctx, previous.key, []DigestTweet{fakeTweet(1, "previous one")}); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = []DigestTweet{fakeTweet(1, "previous one")}
+
+	for run := 0; run < 2; run++ {
+		if _, err := fetchTweets(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Errorf("sent %d emails, want 1", len(m.sent))
+	}
+}
+
+func TestFetchTweetsRetriesFailedDelivery(t *testing.T) {
+	// Windows start at local hours, which differ from UTC’s in Kolkata
+	for _, zone := range []string{"UTC", "Asia/Kolkata"} {
+		t.Run(zone, func(t *testing.T) {
+			source, m := fakeRun(t)
+			var err error
+			location, err = time.LoadLocation(zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Date(2020, 3, 3, 7, 0, 0, 0, time.UTC)
+			clock = func() time.Time { return now }
+			t.Cleanup(func() {
+				clock = time.Now
+				location = time.UTC
+			})
+			m.failures = 1
+			ctx := context.Background()
+			previous := previousWindow(feeds[0], 1)
+			if err := tweetStore.Put(ctx, previous.key, []DigestTweet{fakeTweet(1, "previous one")}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 1); err != nil {
+				t.Fatal(err)
+			}
+			source.timeline = []DigestTweet{fakeTweet(2, "current two")}
+
+			result, err := fetchTweets(ctx)
+			if err == nil || !strings.Contains(err.Error(), "message rejected") {
+				t.Fatalf("failed delivery returned %v", err)
+			}
+			if feed := result.Feeds[0]; feed.Emailed || feed.Pending != previous.key || feed.SinceID != 2 {
+				t.Errorf("feed result is %+v", feed)
+			}
+			// The new tweets are kept despite the failure
+			if ids := storedIDs(t, getTodaysKey(feeds[0])); !reflect.DeepEqual(ids, []int64{2}) {
+				t.Errorf("current window holds %v, want [2]", ids)
+			}
+
+			source.timeline = append([]DigestTweet{fakeTweet(3, "current three")}, source.timeline...)
+			result, err = fetchTweets(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Emailed || len(m.sent) != 1 || !strings.Contains(m.sent[0], "previous one") {
+				t.Errorf("retry emailed %q, want the previous window", m.sent)
+			}
+			if !reflect.DeepEqual(source.sinceIDs, []int64{1, 2}) {
+				t.Errorf("fetched with since_ids %v, want [1 2]", source.sinceIDs)
+			}
+			if pending, err := tweetStore.GetTweetID(ctx, pendingKey(feeds[0])); err != nil || pending != 0 {
+				t.Errorf("window still pending after the retry: %d, %v", pending, err)
+			}
+
+			if _, err := fetchTweets(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.sent) != 1 {
+				t.Errorf("sent %d emails, want 1", len(m.sent))
+			}
+		})
+	}
+}
+
+func TestCatchUpTweets(t *testing.T) {
+	source, m := fakeRun(t)
+	now := time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+	m.failures = 1
+	ctx := context.Background()
+	f := feeds[0]
+	// Three windows over, one of them without tweets, and the current one
+	windows := []window{previousWindow(f, 3), previousWindow(f, 2), previousWindow(f, 1), windowAt(f, now)}
+	tweetIn := func(w window, text string) DigestTweet {
+		return fakeTweet(snowflakeID(w.start)+1, text)
+	}
+	source.timeline = []DigestTweet{tweetIn(windows[3], "current"), tweetIn(windows[2], "third"), tweetIn(windows[0], "first")}
+
+	result, err := catchUpTweets(ctx, windows[0].start, now)
+	if err == nil || !strings.Contains(err.Error(), windows[0].key) {
+		t.Fatalf("catching up returned %v, want the first window’s error", err)
+	}
+	// The first window failing doesn’t stop the others
+	if len(m.sent) != 1 || !strings.Contains(m.sent[0], "third") {
+		t.Errorf("emailed %q, want the third window", m.sent)
+	}
+	if result.NewTweetCount != 3 || result.Feeds[0].Pending != windows[0].key {
+		t.Errorf("result is %+v", result.Feeds[0])
+	}
+	if _, err := tweetStore.Get(ctx, windows[1].key); !errors.Is(err, errNotFound) {
+		t.Errorf("a window without tweets was stored: %v", err)
+	}
+	if ids := storedIDs(t, windows[3].key); !reflect.DeepEqual(ids, []int64{source.timeline[0].ID}) {
+		t.Errorf("current window holds %v, want the current tweet", ids)
+	}
+
+	// The next regular run delivers the pending window, and just it
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 2 || !strings.Contains(m.sent[1], "first") || strings.Contains(m.sent[1], "current") {
+		t.Errorf("emailed %q, want the first window", m.sent[1:])
+	}
+}
+
+func TestFetchTweetsLookbackWindows(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		lookback, stored int
+		emailed          bool
+	}{
+		{"no lookback", 0, 1, false},
+		{"no missed window", 1, 1, true},
+		{"missed windows beyond the lookback", 1, 3, false},
+		{"several missed windows", 3, 3, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			source, m := fakeRun(t)
+			*max_lookback_windows = test.lookback
+			ctx := context.Background()
+			// Without a since_id it is derived from the window found
+			if err := tweetStore.Put(ctx, previousWindow(feeds[0], test.stored).key, []DigestTweet{fakeTweet(5, "stored five")}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := fetchTweets(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if emailed := len(m.sent) == 1 && strings.Contains(m.sent[0], "stored five"); emailed != test.emailed {
+				t.Errorf("stored window emailed: %t, want %t", emailed, test.emailed)
+			}
+			sinceID := int64(0)
+			if test.emailed {
+				sinceID = 5
+			}
+			if !reflect.DeepEqual(source.sinceIDs, []int64{sinceID}) {
+				t.Errorf("fetched with since_ids %v, want [%d]", source.sinceIDs, sinceID)
+			}
+		})
+	}
+}
+
+func TestFetchTweetsRealtime(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mode     string
+		rolling  bool
+		realtime bool
+		invalid  bool
+	}{
+		{name: "digest by default"},
+		{name: "mode realtime", mode: "realtime", realtime: true},
+		{name: "deprecated rolling", rolling: true, realtime: true},
+		{name: "rolling and mode realtime", mode: "realtime", rolling: true, realtime: true},
+		{name: "rolling and mode digest", mode: "digest", rolling: true, invalid: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			source, m := fakeRun(t)
+			if test.mode != "" {
+				*mode = test.mode
+			}
+			*rolling = test.rolling
+			if err := resolveMode(test.mode != ""); (err != nil) != test.invalid {
+				t.Fatalf("resolveMode returned %v, want an error: %t", err, test.invalid)
+			}
+			if test.invalid {
+				return
+			}
+			ctx := context.Background()
+			source.timeline = []DigestTweet{fakeTweet(2, "two"), fakeTweet(1, "one")}
+
+			result, err := fetchTweets(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.realtime {
+				if result.Emailed || len(m.sent) != 0 {
+					t.Errorf("digest mode emailed %q on the window’s first run", m.sent)
+				}
+				return
+			}
+			if !result.Emailed || len(m.sent) != 1 || !strings.Contains(m.sent[0], "one") || !strings.Contains(m.sent[0], "two") {
+				t.Fatalf("first run emailed %q, want tweets 1 and 2", m.sent)
+			}
+
+			source.timeline = append([]DigestTweet{fakeTweet(3, "three")}, source.timeline...)
+			if _, err := fetchTweets(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.sent) != 2 || !strings.Contains(m.sent[1], "three") || strings.Contains(m.sent[1], "two") {
+				t.Errorf("second run emailed %q, want just tweet 3", m.sent[1:])
+			}
+			if !reflect.DeepEqual(source.sinceIDs, []int64{0, 2}) {
+				t.Errorf("fetched with since_ids %v, want [0 2]", source.sinceIDs)
+			}
+			if _, err := tweetStore.Get(ctx, getTodaysKey(feeds[0])); !errors.Is(err, errNotFound) {
+				t.Errorf("tweets were stored in the window: %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchTweetsRealtimeKeepsUnsentTweets(t *testing.T) {
+	source, m := fakeRun(t)
+	*mode = "realtime"
+	m.failures = 1
+	ctx := context.Background()
+	source.timeline = []DigestTweet{fakeTweet(2, "two"), fakeTweet(1, "one")}
+
+	if _, err := fetchTweets(ctx); err == nil {
+		t.Fatal("failed delivery returned no error")
+	}
+	if ids := storedIDs(t, unsentKey(feeds[0])); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("unsent tweets are %v, want [1 2]", ids)
+	}
+	if sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(feeds[0])); err != nil || sinceID != 0 {
+		t.Errorf("since_id moved to %d, %v before delivery", sinceID, err)
+	}
+
+	// Delivered even though Twitter no longer serves them
+	source.timeline = nil
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 || !strings.Contains(m.sent[0], "one") || !strings.Contains(m.sent[0], "two") {
+		t.Errorf("retry emailed %q, want tweets 1 and 2", m.sent)
+	}
+	if sinceID, err := tweetStore.GetTweetID(ctx, sinceIDKey(feeds[0])); err != nil || sinceID != 2 {
+		t.Errorf("since_id is %d, %v, want 2", sinceID, err)
+	}
+	if _, err := tweetStore.Get(ctx, unsentKey(feeds[0])); !errors.Is(err, errNotFound) {
+		t.Errorf("unsent tweets weren’t cleared: %v", err)
+	}
+}
+
+func TestFetchTweetsRealtimeStoppedBeforeClearing(t *testing.T) {
+	source, m := fakeRun(t)
+	*mode = "realtime"
+	ctx := context.Background()
+	// A run that stopped after moving since_id leaves delivered tweets behind
+	if err := tweetStore.Put(ctx, unsentKey(feeds[0]), []DigestTweet{fakeTweet(2, "two"), fakeTweet(1, "one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 2); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = []DigestTweet{fakeTweet(3, "three"), fakeTweet(2, "two"), fakeTweet(1, "one")}
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 || !strings.Contains(m.sent[0], "three") || strings.Contains(m.sent[0], "two") {
+		t.Errorf("emailed %q, want just tweet 3", m.sent)
+	}
+}
+
+// failingIDStore is an fsStore whose PutTweetID fails once for key
+type failingIDStore struct {
+	fsStore
+	key    string
+	failed *bool
+}
+
+func (s failingIDStore) PutTweetID(ctx context.Context, key string, id int64) error {
+	if key == s.key && !*s.failed {
+		*s.failed = true
+		return errors.New("connection reset by peer")
+	}
+	return s.fsStore.PutTweetID(ctx, key, id)
+}
+
+func TestFetchTweetsStoppedBeforeSinceID(t *testing.T) {
+	source, m := fakeRun(t)
+	ctx := context.Background()
+	today := getTodaysKey(feeds[0])
+	if err := tweetStore.Put(ctx, today, []DigestTweet{fakeTweet(1, "one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 1); err != nil {
+		t.Fatal(err)
+	}
+	tweetStore = failingIDStore{fsStore: tweetStore.(fsStore), key: sinceIDKey(feeds[0]), failed: new(bool)}
+	source.timeline = []DigestTweet{fakeTweet(2, "two"), fakeTweet(1, "one")}
+
+	if _, err := fetchTweets(ctx); err == nil {
+		t.Fatal("failing to store since_id returned no error")
+	}
+	if ids := storedIDs(t, today); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("current window holds %v, want [1 2]", ids)
+	}
+
+	// Fetching the same tweets again doesn’t duplicate them
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(source.sinceIDs, []int64{1, 1}) {
+		t.Errorf("fetched with since_ids %v, want [1 1]", source.sinceIDs)
+	}
+	if ids := storedIDs(t, today); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Errorf("current window holds %v, want [1 2]", ids)
+	}
+	if len(m.sent) != 0 {
+		t.Errorf("continuing a window sent %d emails", len(m.sent))
+	}
+}
+
+func TestFetchTweetsEmptyWindows(t *testing.T) {
+	source, m := fakeRun(t)
+	ctx := context.Background()
+	// An empty window is stored when a window starts without new tweets
+	if err := tweetStore.Put(ctx, previousWindow(feeds[0], 1).key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fetchTweets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Emailed || len(m.sent) != 0 {
+		t.Errorf("an empty window was emailed: %+v", result)
+	}
+	if !reflect.DeepEqual(source.sinceIDs, []int64{0}) {
+		t.Errorf("fetched with since_ids %v, want [0]", source.sinceIDs)
+	}
+	if ids := storedIDs(t, getTodaysKey(feeds[0])); len(ids) != 0 {
+		t.Errorf("current window holds %v, want none", ids)
+	}
+}
+
+func TestFetchTweetsSendEmptyDigest(t *testing.T) {
+	_, m := fakeRun(t)
+	*send_empty_digest = true
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	if err := tweetStore.Put(ctx, previous.key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		if _, err := fetchTweets(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(m.sent))
+	}
+	if want := "No new tweets for " + previous.start.Format("Jan 2 15:04") + "–"; !strings.HasPrefix(m.sent[0], want) {
+		t.Errorf("empty digest is %q, want it to start with %q", m.sent[0], want)
+	}
+}
+
+func TestDeliverWindowEmptyOnce(t *testing.T) {
+	_, m := fakeRun(t)
+	*send_empty_digest = true
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+
+	// As a redelivered invocation or a retry of the window would
+	for run := 0; run < 2; run++ {
+		if err := deliverWindow(ctx, feeds[0], previous, nil, &FeedResult{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Errorf("sent %d empty digests, want 1", len(m.sent))
+	}
+}
+
+func TestFetchTweetsRealtimeSendEmptyDigest(t *testing.T) {
+	source, m := fakeRun(t)
+	*mode = "realtime"
+	*send_empty_digest = true
+	ctx := context.Background()
+	now := time.Date(2020, 3, 3, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+
+	// Runs are more frequent than windows, but only the first is emailed
+	for run := 0; run < 2; run++ {
+		if _, err := fetchTweets(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.sent) != 1 || !strings.Contains(m.sent[0], "No new tweets") {
+		t.Fatalf("emailed %q, want one empty digest", m.sent)
+	}
+	now = now.Add(8 * time.Hour)
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 2 || !strings.Contains(m.sent[1], "No new tweets") {
+		t.Fatalf("emailed %q, want an empty digest for the next window", m.sent)
+	}
+
+	// Tweets a failed run left unsent aren’t new, but aren’t nothing either
+	m.failures = 1
+	source.timeline = []DigestTweet{fakeTweet(1, "one")}
+	if _, err := fetchTweets(ctx); err == nil {
+		t.Fatal("failed delivery returned no error")
+	}
+	source.timeline = nil
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 3 || !strings.Contains(m.sent[2], "one") {
+		t.Errorf("emailed %q, want tweet 1", m.sent[2:])
+	}
+}
+
+func TestFetchTweetsDedups(t *testing.T) {
+	source, m := fakeRun(t)
+	ctx := context.Background()
+	previous := previousWindow(feeds[0], 1)
+	// The previous window holds a tweet twice
+	stored := []DigestTweet{fakeTweet(2, "two"), fakeTweet(2, "two"), fakeTweet(1, "one")}
+	if err := tweetStore.Put(ctx, previous.key, stored); err != nil {
+		t.Fatal(err)
+	}
+	// A run failed after storing tweet 3 and before moving since_id past it
+	today := getTodaysKey(feeds[0])
+	if err := tweetStore.Put(ctx, today, []DigestTweet{fakeTweet(3, "three")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tweetStore.PutTweetID(ctx, sinceIDKey(feeds[0]), 2); err != nil {
+		t.Fatal(err)
+	}
+	source.timeline = []DigestTweet{fakeTweet(3, "three")}
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ids := storedIDs(t, today); !reflect.DeepEqual(ids, []int64{3}) {
+		t.Errorf("current window holds %v, want [3]", ids)
+	}
+
+	// Moving on to a new window emails the stored tweets once each
+	if err := tweetStore.Delete(ctx, today); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(m.sent))
+	}
+	if n := strings.Count(m.sent[0], "two"); n != 1 {
+		t.Errorf("email holds tweet 2 %d times: %s", n, m.sent[0])
+	}
+}
+
+func TestParseUnsetConfig(t *testing.T) {
+	fs := defineConfig()
+	// Set from the environment or config.json
+	if err := fs.Set("from", "env@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `{"from": "s3@example.com", "mute-keywords": ["spoiler", "giveaway"], "window-hours": 6}`
+	if err := parseUnsetConfig(fs, strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	if *from != "env@example.com" {
+		t.Errorf("from is %q, the S3 config overrode it", *from)
+	}
+	if !reflect.DeepEqual([]string(mute_keywords), []string{"spoiler", "giveaway"}) || *window_hours != 6 {
+		t.Errorf("mute-keywords is %q and window-hours %d, want them from the S3 config", mute_keywords, *window_hours)
+	}
+
+	if err := parseUnsetConfig(fs, strings.NewReader(`{"no-such-option": 1}`)); err == nil {
+		t.Error("an unknown option was accepted")
+	}
+	if err := loadS3Config(fs, "https://example.com/config.json"); err == nil {
+		t.Error("a URI that isn’t s3:// was accepted")
+	}
+}
+
+func TestStripTracking(t *testing.T) {
+	defineConfig()
+	*strip_tracking_params = true
+
+	tests := []struct {
+		href     string
+		expected string
+	}{
+		{"https://example.com/a?utm_source=twitter&utm_medium=social", "https://example.com/a"},
+		{"https://example.com/a?id=1&fbclid=abc&page=2#top", "https://example.com/a?id=1&page=2#top"},
+		{"https://example.com/utm_source/a?q=a%20b", "https://example.com/utm_source/a?q=a%20b"},
+		{"https://example.com/a#utm_source=twitter", "https://example.com/a#utm_source=twitter"},
+		{"https://example.com/a?%75tm_campaign=x&b", "https://example.com/a?b"},
+	}
+	for _, test := range tests {
+		if href := stripTracking(test.href); href != test.expected {
+			t.Errorf("stripping %s: expected %s, got %s", test.href, test.expected, href)
+		}
+	}
+
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: "Read this https://t.co/abc",
+		Entities: &TweetEntities{Urls: []URLEntity{{
+			Indices:     Indices{10, 26},
+			URL:         "https://t.co/abc",
+			ExpandedURL: "https://example.com/post?utm_source=twitter",
+			DisplayURL:  "example.com/post?utm_source=…",
+		}}},
+		User: &TweetUser{Name: "Alice", ScreenName: "alice"},
+	}
+	html := buildTweet(&tweet)
+	if !strings.Contains(html, `href="https://example.com/post"`) || !strings.Contains(html, "example.com/post?utm_source=…") {
+		t.Errorf("Output doesn’t link to the stripped URL with the original label: %s", html)
+	}
+
+	*strip_tracking_params = false
+	if href := stripTracking(tests[0].href); href != tests[0].href {
+		t.Errorf("stripped %s without strip-tracking-params: %s", tests[0].href, href)
+	}
+}
+
+func TestStitchSelfThreads(t *testing.T) {
+	defineConfig()
+	*stitch_self_threads = true
+	alice := &TweetUser{ID: 1, Name: "Alice", ScreenName: "alice"}
+	bob := &TweetUser{ID: 2, Name: "Bob", ScreenName: "bob"}
+
+	tweets := []DigestTweet{
+		{ID: 10, FullText: "Thread start 1/3", User: alice},
+		{ID: 11, FullText: "Unrelated tweet", User: bob},
+		{ID: 12, FullText: "Thread middle 2/3", User: alice, InReplyToStatusID: 10, InReplyToUserID: 1},
+		{ID: 13, FullText: "Bob replying", User: bob, InReplyToStatusID: 12, InReplyToUserID: 1},
+		{ID: 14, FullText: "Thread end 3/3", User: alice, InReplyToStatusID: 12, InReplyToUserID: 1},
+	}
+	htmlBody, textBody := buildDigest(tweets)
+
+	if n := strings.Count(htmlBody, "@alice</span>"); n != 1 {
+		t.Errorf("self-thread rendered as %d cards: %s", n, htmlBody)
+	}
+	start := strings.Index(htmlBody, "Thread start")
+	middle := strings.Index(htmlBody, "Thread middle")
+	end := strings.Index(htmlBody, "Thread end")
+	unrelated := strings.Index(htmlBody, "Unrelated tweet")
+	if start < 0 || !(start < middle && middle < end && end < unrelated) {
+		t.Errorf("self-thread isn’t one card before the next tweet: %s", htmlBody)
+	}
+	if n := strings.Count(htmlBody, "@bob</span>"); n != 2 {
+		t.Errorf("%d cards by Bob, want 2: %s", n, htmlBody)
+	}
+	if !strings.Contains(textBody, "Thread start 1/3\n\nThread middle 2/3\n\nThread end 3/3\n") {
+		t.Errorf("plain text doesn’t stitch the self-thread: %s", textBody)
+	}
+
+	*stitch_self_threads = false
+	htmlBody, _ = buildDigest(tweets)
+	if n := strings.Count(htmlBody, "@alice</span>"); n != 3 {
+		t.Errorf("self-thread rendered as %d cards without stitch-self-threads, want 3", n)
+	}
+}
+
+func TestProxyImage(t *testing.T) {
+	defineConfig()
+	src := "https://pbs.twimg.com/media/abc.jpg?format=jpg&name=large"
+	if proxied := proxyImage(src); proxied != src {
+		t.Errorf("proxied %s without image-proxy-base: %s", src, proxied)
+	}
+
+	*image_proxy_base = "https://proxy.example.com/?url="
+	expected := "https://proxy.example.com/?url=https%3A%2F%2Fpbs.twimg.com%2Fmedia%2Fabc.jpg%3Fformat%3Djpg%26name%3Dlarge"
+	if proxied := proxyImage(src); proxied != expected {
+		t.Errorf("proxying %s: expected %s, got %s", src, expected, proxied)
+	}
+	if proxied := proxyImage("data:image/png;base64,AAAA"); proxied != "data:image/png;base64,AAAA" {
+		t.Errorf("proxied a data URL: %s", proxied)
+	}
+
+	tweet := DigestTweet{
+		ID:       1,
+		FullText: "A photo https://t.co/photo",
+		User:     &TweetUser{Name: "Alice", ScreenName: "alice", ProfileImageURLHttps: "https://pbs.twimg.com/profile_images/1/a_normal.jpg"},
+		ExtendedEntities: &ExtendedEntities{Media: []MediaEntity{
+			{URLEntity: URLEntity{Indices: Indices{8, 26}, URL: "https://t.co/photo"}, Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/abc.jpg"},
+		}},
+	}
+	html := buildTweet(&tweet)
+	for _, expected := range []string{
+		`<img src="https://proxy.example.com/?url=https%3A%2F%2Fpbs.twimg.com%2Fprofile_images%2F1%2Fa_reasonably_small.jpg"`,
+		`<img src="https://proxy.example.com/?url=https%3A%2F%2Fpbs.twimg.com%2Fmedia%2Fabc.jpg"`,
+	} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Output is missing %s: %s", expected, html)
+		}
+	}
+}
+
+func TestFetchTweetsDropsStaleTweets(t *testing.T) {
+	source, m := fakeRun(t)
+	now := time.Date(2020, 3, 3, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = time.Now })
+	ctx := context.Background()
+
+	// The previous window holds a tweet of its own and one carried forward
+	// from days before, stored before since_id was tracked on its own
+	previous := previousWindow(feeds[0], 1)
+	fresh := fakeTweet(7, "fresh tweet")
+	fresh.CreatedAt = previous.start.Add(time.Hour).Format(time.RubyDate)
+	stale := fakeTweet(9, "stale tweet")
+	stale.CreatedAt = previous.start.Add(-72 * time.Hour).Format(time.RubyDate)
+	if err := tweetStore.Put(ctx, previous.key, []DigestTweet{stale, fresh}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fetchTweets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(m.sent))
+	}
+	if !strings.Contains(m.sent[0], "fresh tweet") || strings.Contains(m.sent[0], "stale tweet") {
+		t.Errorf("email doesn’t hold just the fresh tweet: %s", m.sent[0])
+	}
+	if !reflect.DeepEqual(source.sinceIDs, []int64{9}) {
+		t.Errorf("fetched with since_ids %v, want [9]", source.sinceIDs)
+	}
+	if emailed, err := tweetStore.GetTweetID(ctx, emailedKey(previous.key)); err != nil || emailed != 9 {
+		t.Errorf("emailed marker is %d, %v, want 9", emailed, err)
+	}
+}
+
+func TestBuildEmailsFeedIdentity(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	w := window{start: start, end: start.Add(8 * time.Hour)}
+	tweets := []DigestTweet{{ID: 1, FullText: "Hello", CreatedAt: start.Add(time.Hour).Format(time.RubyDate), User: &TweetUser{Name: "Alice", ScreenName: "alice"}}}
+
+	news := &feed{Name: "news", Title: "World news"}
+	emails, err := buildEmails(news, w, tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails[0].subject != "[World news] 1 tweets · Mar 3 09:00–09:00" {
+		t.Errorf("named feed’s subject is %q", emails[0].subject)
+	}
+	if !strings.Contains(emails[0].htmlBody, ">World news digest</div>") || !strings.HasPrefix(emails[0].textBody, "World news digest\n\n") {
+		t.Errorf("named feed’s email doesn’t say which feed it is from: %s", emails[0].htmlBody)
+	}
+
+	emails, err = buildEmails(&feed{}, w, tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails[0].subject != "1 tweets · Mar 3 09:00–09:00" || strings.Contains(emails[0].textBody, "digest") {
+		t.Errorf("default feed’s email changed: %q, %s", emails[0].subject, emails[0].textBody)
+	}
+}
+
+func TestCompactLayout(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	cardTemplate = compactCard
+	defer func() { cardTemplate = defaultCard }()
+
+	retweet := DigestTweet{
+		ID:   2,
+		User: &TweetUser{Name: "Bob", ScreenName: "bob"},
+		RetweetedStatus: &DigestTweet{
+			ID:        1,
+			CreatedAt: "Tue Mar 03 14:05:00 +0000 2020",
+			FullText:  "Hello",
+			User:      &TweetUser{Name: "Alice", ScreenName: "alice", ProfileImageURLHttps: "https://pbs.twimg.com/profile_images/1/a_normal.jpg"},
+		},
+	}
+	html := buildTweet(&retweet)
+	for _, expected := range []string{"Bob Retweeted", "@alice</span>", "· Mar 3 14:05", "Hello", `style="height: 36px; width: 36px;"`} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("Compact card is missing %q: %s", expected, html)
+		}
+	}
+	if strings.Contains(html, "100px") {
+		t.Errorf("Compact card has the full layout’s avatar: %s", html)
+	}
+}
+
+func TestDedupTweetsKeepsLatestEdit(t *testing.T) {
+	defineConfig()
+	alice := &TweetUser{Name: "Alice", ScreenName: "alice"}
+	original := DigestTweet{ID: 4, FullText: "Helo world", User: alice}
+	edit := DigestTweet{ID: 5, FullText: "Hello world", User: alice, EditHistoryTweetIDs: []int64{4, 5}}
+	other := DigestTweet{ID: 6, FullText: "Another tweet", User: alice}
+
+	// The edit was fetched after the original was stored
+	merged := mergeTweets([]DigestTweet{edit, other}, []DigestTweet{original})
+	var ids []int64
+	for _, tweet := range merged {
+		ids = append(ids, tweet.ID)
+	}
+	if !reflect.DeepEqual(ids, []int64{5, 6}) {
+		t.Errorf("merged tweets are %v, want [5 6]", ids)
+	}
+
+	html := buildTweet(&merged[0])
+	if !strings.Contains(html, "Hello world") || !strings.Contains(html, "· Edited") {
+		t.Errorf("Output doesn’t mark the edit: %s", html)
+	}
+	if text := buildTweetText(&merged[0]); !strings.Contains(text, "· Edited") {
+		t.Errorf("Plain text doesn’t mark the edit: %s", text)
+	}
+	if html := buildTweet(&other); strings.Contains(html, "Edited") {
+		t.Errorf("Output marks an unedited tweet: %s", html)
+	}
+}
+
+func TestEngagement(t *testing.T) {
+	defineConfig()
+	for n, expected := range map[int]string{0: "0", 999: "999", 1000: "1K", 1250: "1.2K", 999999: "999.9K", 3400000: "3.4M"} {
+		if count := compactCount(n); count != expected {
+			t.Errorf("compactCount(%d) is %s, want %s", n, count, expected)
+		}
+	}
+
+	retweet := DigestTweet{
+		ID:   2,
+		User: &TweetUser{Name: "Bob", ScreenName: "bob"},
+		RetweetedStatus: &DigestTweet{
+			ID:            1,
+			FullText:      "Popular",
+			User:          &TweetUser{Name: "Alice", ScreenName: "alice"},
+			FavoriteCount: 1250,
+			RetweetCount:  340,
+		},
+	}
+	if html := buildTweet(&retweet); strings.Contains(html, "Likes") {
+		t.Errorf("Output shows engagement without show-engagement: %s", html)
+	}
+
+	*show_engagement = true
+	if html := buildTweet(&retweet); !strings.Contains(html, ">1.2K Likes · 340 Retweets</div>") {
+		t.Errorf("Output is missing the retweeted tweet’s engagement: %s", html)
+	}
+	if text := buildTweetText(&retweet); !strings.Contains(text, "1.2K Likes · 340 Retweets\n") {
+		t.Errorf("Plain text is missing the engagement: %s", text)
+	}
+}
+
+func TestBuildDigestUnavailableTweets(t *testing.T) {
+	defineConfig()
+	*group_threads = false
+	*stitch_self_threads = false
+	tweets := []DigestTweet{
+		{ID: 1, FullText: "Deleted"},
+		{ID: 2, FullText: "Quoting", User: &TweetUser{Name: "Alice", ScreenName: "alice"}, QuotedStatusID: 1, QuotedStatus: &DigestTweet{ID: 1}},
+		{ID: 3, User: &TweetUser{Name: "Bob", ScreenName: "bob"}, RetweetedStatus: &DigestTweet{ID: 1}},
+		{ID: 4, FullText: "Still here", User: &TweetUser{Name: "Carol", ScreenName: "carol"}},
+	}
+
+	html, text := buildDigest(collapseRetweets(tweets))
+	if count := strings.Count(html, msgs.Unavailable); count != 3 {
+		t.Errorf("Output has %d placeholders, want 3: %s", count, html)
+	}
+	if !strings.Contains(html, "https://twitter.com/i/web/status/1") {
+		t.Errorf("Output doesn’t link to the unavailable tweet: %s", html)
+	}
+	for _, expected := range []string{"Quoting", "Still here"} {
+		if !strings.Contains(html, expected) || !strings.Contains(text, expected) {
+			t.Errorf("Digest is missing %q: %s\n%s", expected, html, text)
+		}
+	}
+	if !strings.Contains(text, "> "+msgs.Unavailable+"\n") {
+		t.Errorf("Plain text is missing the unavailable quoted tweet: %s", text)
+	}
+
+	if markdown := buildMarkdown("Digest", tweets); !strings.Contains(markdown, "Still here") {
+		t.Errorf("Markdown is missing the other tweets: %s", markdown)
+	}
+	if messages := buildSlackMessages(tweets); len(messages) != 1 || len(messages[0].Blocks) != 8 {
+		t.Errorf("Slack messages are %+v, want 4 tweets in one", messages)
+	}
+	if _, err := buildAtom(&feed{}, tweets); err != nil {
+		t.Errorf("buildAtom failed: %v", err)
+	}
+}
+
+func TestSubjectPrefix(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	*subject_prefix = "t2e"
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	w := window{start: start, end: start.Add(8 * time.Hour)}
+	tweets := []DigestTweet{{ID: 1, FullText: "Hallo", CreatedAt: start.Add(time.Hour).Format(time.RubyDate), User: &TweetUser{Name: "Alice", ScreenName: "alice"}}}
+
+	msgs = locales["de"]
+	t.Cleanup(func() { msgs = locales["en"] })
+	emails, err := buildEmails(&feed{Name: "news", Title: "news"}, w, tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails[0].subject != "[t2e] [news] 1 Tweets · 3.3. 09:00–09:00" {
+		t.Errorf("localized subject is %q", emails[0].subject)
+	}
+
+	emails, err = buildEmails(&feed{SubjectTemplate: "{{.Count}} new"}, w, tweets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails[0].subject != "[t2e] 1 new" {
+		t.Errorf("templated subject is %q", emails[0].subject)
+	}
+}
+
+func TestFilterTweetsOnlyUsers(t *testing.T) {
+	defineConfig()
+	alice := &TweetUser{Name: "Alice", ScreenName: "Alice"}
+	bob := &TweetUser{Name: "Bob", ScreenName: "bob"}
+	tweets := []DigestTweet{
+		{ID: 1, User: alice},
+		{ID: 2, User: bob},
+		{ID: 3, User: bob, RetweetedStatus: &DigestTweet{ID: 10, User: alice}},
+		{ID: 4, User: alice, RetweetedStatus: &DigestTweet{ID: 11, User: bob}},
+		{ID: 5},
+	}
+	kept := func() []int64 {
+		var ids []int64
+		for _, tweet := range filterTweets(append([]DigestTweet{}, tweets...)) {
+			ids = append(ids, tweet.ID)
+		}
+		return ids
+	}
+
+	if ids := kept(); len(ids) != len(tweets) {
+		t.Errorf("without only-users, kept %v", ids)
+	}
+	only_users = stringList{"@alice"}
+	if ids := kept(); !reflect.DeepEqual(ids, []int64{1, 3}) {
+		t.Errorf("kept %v, want [1 3]", ids)
+	}
+	*only_users_retweets = true
+	if ids := kept(); !reflect.DeepEqual(ids, []int64{1, 3, 4}) {
+		t.Errorf("with only-users-retweets, kept %v, want [1 3 4]", ids)
+	}
+	mute_users = stringList{"bob"}
+	if ids := kept(); !reflect.DeepEqual(ids, []int64{1}) {
+		t.Errorf("with bob muted, kept %v, want [1]", ids)
+	}
+}
+
+func TestEmailCompat(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+	*email_compat = true
+	*digest_header = true
+	defer func() { cardTemplate = defaultCard }()
+
+	start := time.Date(2020, 3, 3, 8, 0, 0, 0, time.UTC)
+	w := window{start: start, end: start.Add(8 * time.Hour)}
+	alice := &TweetUser{Name: "Alice", ScreenName: "alice", ProfileImageURLHttps: "https://pbs.twimg.com/profile_images/1/a_normal.jpg"}
+	media := &ExtendedEntities{Media: []MediaEntity{
+		{Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/1.jpg"},
+		{Type: "photo", MediaURLHttps: "https://pbs.twimg.com/media/2.jpg"},
+		{Type: "video", MediaURLHttps: "https://pbs.twimg.com/media/3.jpg", VideoInfo: VideoInfo{DurationMillis: 42000}},
+	}}
+	tweets := []DigestTweet{
+		{ID: 1, FullText: "Photos", CreatedAt: start.Add(time.Hour).Format(time.RubyDate), User: alice, ExtendedEntities: media},
+		{ID: 2, FullText: "Quoting", User: &TweetUser{Name: "Bob", ScreenName: "bob"}, RetweetedStatus: &DigestTweet{
+			ID: 3, FullText: "Quoting", User: alice, QuotedStatusID: 1, QuotedStatus: &DigestTweet{ID: 1, FullText: "Photos", User: alice},
+		}},
+	}
+
+	for _, card := range []*htmltemplate.Template{compatCard, compactCompatCard} {
+		cardTemplate = card
+		emails, err := buildEmails(&feed{Name: "news", Title: "news"}, w, tweets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		html := emails[0].htmlBody
+		for _, unsupported := range []string{"display: flex", "system-ui", "position: absolute", "<svg"} {
+			if strings.Contains(html, unsupported) {
+				t.Errorf("Compatible email uses %q: %s", unsupported, html)
+			}
+		}
+		for _, expected := range []string{`<table role="presentation"`, "Bob Retweeted", `width="246"`, "&#9654; 0:42", "@alice</span>", "news digest"} {
+			if !strings.Contains(html, expected) {
+				t.Errorf("Compatible email is missing %q: %s", expected, html)
+			}
+		}
+	}
+}
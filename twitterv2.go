@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// v2TimelineURL is the endpoint for the reverse chronological home timeline
+// of a user in the v2 API, where %s is their user ID
+const v2TimelineURL = "https://api.twitter.com/2/users/%s/timelines/reverse_chronological"
+
+// v2UsersMeURL is the endpoint for the user authorizing requests in the v2 API
+const v2UsersMeURL = "https://api.twitter.com/2/users/me"
+
+// maxV2Count is the most tweets the v2 home timeline returns per page
+const maxV2Count = 100
+
+// v2Response is a page of tweets from the v2 API, with the users, tweets and
+// media they reference
+type v2Response struct {
+	Data     []v2Tweet `json:"data"`
+	Includes struct {
+		Users  []v2User  `json:"users"`
+		Tweets []v2Tweet `json:"tweets"`
+		Media  []v2Media `json:"media"`
+	} `json:"includes"`
+}
+
+type v2Tweet struct {
+	ID              string `json:"id"`
+	Text            string `json:"text"`
+	AuthorID        string `json:"author_id"`
+	CreatedAt       string `json:"created_at"`
+	InReplyToUserID string `json:"in_reply_to_user_id"`
+	PublicMetrics   struct {
+		LikeCount    int `json:"like_count"`
+		RetweetCount int `json:"retweet_count"`
+	} `json:"public_metrics"`
+	// Every version of the tweet, oldest first
+	EditHistoryTweetIDs []string `json:"edit_history_tweet_ids"`
+	ReferencedTweets    []struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"referenced_tweets"`
+	Attachments struct {
+		MediaKeys []string `json:"media_keys"`
+	} `json:"attachments"`
+	Entities struct {
+		URLs []struct {
+			Start       int    `json:"start"`
+			End         int    `json:"end"`
+			URL         string `json:"url"`
+			ExpandedURL string `json:"expanded_url"`
+			DisplayURL  string `json:"display_url"`
+			MediaKey    string `json:"media_key"`
+		} `json:"urls"`
+		Hashtags []struct {
+			Start int    `json:"start"`
+			End   int    `json:"end"`
+			Tag   string `json:"tag"`
+		} `json:"hashtags"`
+		Mentions []struct {
+			Start    int    `json:"start"`
+			End      int    `json:"end"`
+			Username string `json:"username"`
+		} `json:"mentions"`
+	} `json:"entities"`
+}
+
+type v2User struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Username        string `json:"username"`
+	ProfileImageURL string `json:"profile_image_url"`
+}
+
+type v2Media struct {
+	MediaKey        string `json:"media_key"`
+	Type            string `json:"type"`
+	URL             string `json:"url"`
+	PreviewImageURL string `json:"preview_image_url"`
+	DurationMS      int    `json:"duration_ms"`
+	Variants        []struct {
+		BitRate     int    `json:"bit_rate"`
+		ContentType string `json:"content_type"`
+		URL         string `json:"url"`
+	} `json:"variants"`
+}
+
+// v2Error is the body of a failed v2 API call
+type v2Error struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// getV2HomeTimeline retrieves a page of the home timeline from the v2 API,
+// with tweets newer than sinceID and no newer than maxID unless they are 0
+func getV2HomeTimeline(httpClient *http.Client, sinceID, maxID int64) ([]DigestTweet, *http.Response, error) {
+	userID, resp, err := v2UserID(httpClient)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	params := neturl.Values{}
+	count := *count
+	if count > maxV2Count {
+		count = maxV2Count
+	}
+	params.Set("max_results", strconv.Itoa(count))
+	params.Set("tweet.fields", "created_at,author_id,in_reply_to_user_id,referenced_tweets,attachments,entities,edit_history_tweet_ids,public_metrics")
+	params.Set("expansions", "author_id,referenced_tweets.id,referenced_tweets.id.author_id,attachments.media_keys")
+	params.Set("user.fields", "name,username,profile_image_url")
+	params.Set("media.fields", "type,url,preview_image_url,duration_ms,variants")
+	if sinceID != 0 {
+		params.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if maxID != 0 {
+		// until_id is exclusive, max_id inclusive
+		params.Set("until_id", strconv.FormatInt(maxID+1, 10))
+	}
+
+	var page v2Response
+	resp, err = getV2(httpClient, fmt.Sprintf(v2TimelineURL, neturl.PathEscape(userID))+"?"+params.Encode(), &page)
+	if err != nil {
+		return nil, resp, err
+	}
+	return page.tweets(), resp, nil
+}
+
+// v2UserID returns the ID of the user authorizing requests. Access tokens
+// start with it, failing that it is looked up.
+func v2UserID(httpClient *http.Client) (string, *http.Response, error) {
+	if id := strings.SplitN(*access_token, "-", 2)[0]; id != "" {
+		if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+			return id, nil, nil
+		}
+	}
+
+	var me struct {
+		Data v2User `json:"data"`
+	}
+	resp, err := getV2(httpClient, v2UsersMeURL, &me)
+	if err != nil {
+		return "", resp, err
+	}
+	if me.Data.ID == "" {
+		return "", resp, errors.New("twitter: no user ID in users/me")
+	}
+	return me.Data.ID, resp, nil
+}
+
+// getV2 calls a v2 API endpoint and decodes the response into v
+func getV2(httpClient *http.Client, url string, v interface{}) (*http.Response, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return resp, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiError v2Error
+		if json.NewDecoder(resp.Body).Decode(&apiError) != nil || apiError.Title == "" {
+			return resp, fmt.Errorf("twitter: %s", resp.Status)
+		}
+		return resp, fmt.Errorf("twitter: %s: %s", apiError.Title, apiError.Detail)
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// tweets converts the tweets of a v2 page to the tweets the rest of the code
+// works with
+func (r v2Response) tweets() []DigestTweet {
+	users := map[string]*TweetUser{}
+	for _, u := range r.Includes.Users {
+		id, _ := strconv.ParseInt(u.ID, 10, 64)
+		users[u.ID] = &TweetUser{
+			ID:                   id,
+			Name:                 u.Name,
+			ScreenName:           u.Username,
+			ProfileImageURLHttps: u.ProfileImageURL,
+		}
+	}
+	media := map[string]v2Media{}
+	for _, m := range r.Includes.Media {
+		media[m.MediaKey] = m
+	}
+	referenced := map[string]v2Tweet{}
+	for _, t := range r.Includes.Tweets {
+		referenced[t.ID] = t
+	}
+
+	tweets := make([]DigestTweet, 0, len(r.Data))
+	for _, t := range r.Data {
+		tweet := t.tweet(users, media)
+		for _, ref := range t.ReferencedTweets {
+			target, ok := referenced[ref.ID]
+			if !ok {
+				continue
+			}
+			switch ref.Type {
+			case "retweeted":
+				retweeted := target.tweet(users, media)
+				tweet.RetweetedStatus = &retweeted
+			case "quoted":
+				quoted := target.tweet(users, media)
+				tweet.QuotedStatus = &quoted
+				tweet.QuotedStatusID = quoted.ID
+			}
+		}
+		tweets = append(tweets, tweet)
+	}
+	return tweets
+}
+
+// tweet converts a v2 tweet, without the tweets it references. Its User is
+// left nil when its author isn’t included, as for suspended users, so that it
+// is shown as unavailable.
+func (t v2Tweet) tweet(users map[string]*TweetUser, media map[string]v2Media) DigestTweet {
+	id, _ := strconv.ParseInt(t.ID, 10, 64)
+	tweet := DigestTweet{
+		ID:       id,
+		FullText: t.Text,
+		User:     users[t.AuthorID],
+		Entities: &TweetEntities{},
+	}
+	if createdAt, err := time.Parse(time.RFC3339, t.CreatedAt); err == nil {
+		tweet.CreatedAt = createdAt.Format(time.RubyDate)
+	}
+	tweet.InReplyToUserID, _ = strconv.ParseInt(t.InReplyToUserID, 10, 64)
+	tweet.FavoriteCount = t.PublicMetrics.LikeCount
+	tweet.RetweetCount = t.PublicMetrics.RetweetCount
+	// Unedited tweets list only themselves
+	if len(t.EditHistoryTweetIDs) > 1 {
+		for _, edit := range t.EditHistoryTweetIDs {
+			editID, _ := strconv.ParseInt(edit, 10, 64)
+			tweet.EditHistoryTweetIDs = append(tweet.EditHistoryTweetIDs, editID)
+		}
+	}
+	for _, ref := range t.ReferencedTweets {
+		if ref.Type == "replied_to" {
+			tweet.InReplyToStatusID, _ = strconv.ParseInt(ref.ID, 10, 64)
+		}
+	}
+
+	// The v2 API lists links to media among the other links
+	mediaLinks := map[string]URLEntity{}
+	for _, u := range t.Entities.URLs {
+		entity := URLEntity{
+			Indices:     Indices{u.Start, u.End},
+			URL:         u.URL,
+			ExpandedURL: u.ExpandedURL,
+			DisplayURL:  u.DisplayURL,
+		}
+		if u.MediaKey != "" {
+			mediaLinks[u.MediaKey] = entity
+			continue
+		}
+		tweet.Entities.Urls = append(tweet.Entities.Urls, entity)
+	}
+	for _, h := range t.Entities.Hashtags {
+		tweet.Entities.Hashtags = append(tweet.Entities.Hashtags, HashtagEntity{
+			Indices: Indices{h.Start, h.End},
+			Text:    h.Tag,
+		})
+	}
+	for _, m := range t.Entities.Mentions {
+		tweet.Entities.UserMentions = append(tweet.Entities.UserMentions, MentionEntity{
+			Indices:    Indices{m.Start, m.End},
+			ScreenName: m.Username,
+		})
+	}
+
+	for _, key := range t.Attachments.MediaKeys {
+		m, ok := media[key]
+		if !ok {
+			continue
+		}
+		entity := MediaEntity{URLEntity: mediaLinks[key], Type: m.Type, MediaURLHttps: m.URL}
+		if m.Type != "photo" {
+			entity.MediaURLHttps = m.PreviewImageURL
+			entity.VideoInfo.DurationMillis = m.DurationMS
+			for _, v := range m.Variants {
+				entity.VideoInfo.Variants = append(entity.VideoInfo.Variants, VideoVariant{
+					ContentType: v.ContentType,
+					Bitrate:     v.BitRate,
+					URL:         v.URL,
+				})
+			}
+		}
+		if tweet.ExtendedEntities == nil {
+			tweet.ExtendedEntities = &ExtendedEntities{}
+		}
+		tweet.ExtendedEntities.Media = append(tweet.ExtendedEntities.Media, entity)
+	}
+	return tweet
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestV2ResponseTweets(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	const body = `{
+  "data": [
+    {"id": "3", "text": "RT @alice: Look https://t.co/pic", "author_id": "20", "created_at": "2020-03-03T14:10:00.000Z",
+     "referenced_tweets": [{"type": "retweeted", "id": "2"}]},
+    {"id": "1", "text": "Hi @bob #go https://t.co/link", "author_id": "10", "created_at": "2020-03-03T14:05:00.000Z",
+     "in_reply_to_user_id": "20", "referenced_tweets": [{"type": "replied_to", "id": "0"}],
+     "entities": {
+       "mentions": [{"start": 3, "end": 7, "username": "bob"}],
+       "hashtags": [{"start": 8, "end": 11, "tag": "go"}],
+       "urls": [{"start": 12, "end": 29, "url": "https://t.co/link", "expanded_url": "https://go.dev", "display_url": "go.dev"}]
+     }}
+  ],
+  "includes": {
+    "users": [
+      {"id": "10", "name": "Alice", "username": "alice", "profile_image_url": "https://pbs.twimg.com/alice_normal.jpg"},
+      {"id": "20", "name": "Bob", "username": "bob"}
+    ],
+    "tweets": [
+      {"id": "2", "text": "Look https://t.co/pic", "author_id": "10", "created_at": "2020-03-03T14:00:00.000Z",
+       "attachments": {"media_keys": ["3_1"]},
+       "entities": {"urls": [{"start": 5, "end": 21, "url": "https://t.co/pic", "expanded_url": "https://twitter.com/alice/status/2/photo/1", "media_key": "3_1"}]}}
+    ],
+    "media": [{"media_key": "3_1", "type": "photo", "url": "https://pbs.twimg.com/media/pic.jpg"}]
+  }
+}`
+	var page v2Response
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	tweets := page.tweets()
+	if len(tweets) != 2 {
+		t.Fatalf("got %d tweets, want 2", len(tweets))
+	}
+
+	retweet := tweets[0]
+	if retweet.ID != 3 || retweet.User.ScreenName != "bob" || retweet.RetweetedStatus == nil || retweet.RetweetedStatus.User.Name != "Alice" {
+		t.Fatalf("retweet is %+v", retweet)
+	}
+	html := buildTweet(&retweet)
+	if !strings.Contains(html, "https://pbs.twimg.com/media/pic.jpg") || strings.Contains(html, "t.co/pic") {
+		t.Errorf("retweeted photo isn't rendered in place of its link: %s", html)
+	}
+	if !strings.Contains(html, "Mar 3 14:00") {
+		t.Errorf("retweeted tweet is missing its posting time: %s", html)
+	}
+
+	reply := tweets[1]
+	if !isReply(&reply) || reply.InReplyToUserID != 20 {
+		t.Errorf("reply isn't one: %+v", reply)
+	}
+	html = buildTweet(&reply)
+	for _, link := range []string{`href="https://twitter.com/bob"`, `href="https://twitter.com/hashtag/go"`, `href="https://go.dev"`} {
+		if !strings.Contains(html, link) {
+			t.Errorf("Output is missing %s: %s", link, html)
+		}
+	}
+}
+
+func TestV2ResponseMissingAuthor(t *testing.T) {
+	defineConfig()
+	location = time.UTC
+
+	const body = `{
+  "data": [
+    {"id": "5", "text": "Gone", "author_id": "99", "created_at": "2020-03-03T14:10:00.000Z"},
+    {"id": "4", "text": "Look at this", "author_id": "10", "created_at": "2020-03-03T14:05:00.000Z",
+     "referenced_tweets": [{"type": "quoted", "id": "3"}]}
+  ],
+  "includes": {
+    "users": [{"id": "10", "name": "Alice", "username": "alice"}],
+    "tweets": [{"id": "3", "text": "Also gone", "author_id": "98", "created_at": "2020-03-03T14:00:00.000Z"}]
+  }
+}`
+	var page v2Response
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	tweets := page.tweets()
+	if len(tweets) != 2 {
+		t.Fatalf("got %d tweets, want 2", len(tweets))
+	}
+
+	gone := tweets[0]
+	if gone.User != nil || !gone.Unavailable() {
+		t.Fatalf("tweet without its author is %+v", gone)
+	}
+	html := buildTweet(&gone)
+	if !strings.Contains(html, msgs.Unavailable) || !strings.Contains(html, "https://twitter.com/i/web/status/5") || strings.Contains(html, "twitter.com//") {
+		t.Errorf("tweet without its author isn't a placeholder: %s", html)
+	}
+
+	quoting := tweets[1]
+	if quoting.Unavailable() || quoting.QuotedStatus == nil || quoting.QuotedStatus.User != nil {
+		t.Fatalf("tweet quoting a tweet without its author is %+v", quoting)
+	}
+	html = buildTweet(&quoting)
+	if !strings.Contains(html, msgs.Unavailable) || strings.Contains(html, "twitter.com//") {
+		t.Errorf("quoted tweet without its author isn't a placeholder: %s", html)
+	}
+}
+
+func TestV2ResponseEditedTweets(t *testing.T) {
+	const body = `{
+  "data": [
+    {"id": "5", "text": "Fixed typo", "author_id": "10", "edit_history_tweet_ids": ["4", "5"]},
+    {"id": "3", "text": "Never edited", "author_id": "10", "edit_history_tweet_ids": ["3"]}
+  ],
+  "includes": {"users": [{"id": "10", "name": "Alice", "username": "alice"}]}
+}`
+	var page v2Response
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	tweets := page.tweets()
+	if len(tweets) != 2 {
+		t.Fatalf("got %d tweets, want 2", len(tweets))
+	}
+	if !tweets[0].Edited() || tweets[0].InitialID() != 4 {
+		t.Errorf("edit isn’t one of tweet 4: %+v", tweets[0])
+	}
+	if tweets[1].Edited() || tweets[1].EditHistoryTweetIDs != nil {
+		t.Errorf("unedited tweet is an edit: %+v", tweets[1])
+	}
+}